@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"conda-rlookup/indexer"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand that works on what earlier runs left in the working directory of svr, rather
+// than indexing anything. args are the arguments following its name.
+type command struct {
+	usage string
+	run   func(svr *domain.CondaServer, args []string) error
+}
+
+var commands = map[string]command{
+	"failures":    {"[-poisoned] [-json] [subdir...]: list packages that failed to be indexed", listFailures},
+	"symbols":     {"[-json] [-subdirs subdir,...] symbol[@version]...: list packages whose shared libraries export symbols", findSymbols},
+	"modules":     {"[-json] [-subdirs subdir,...] import...: list packages that Python imports load modules of", findPythonImports},
+	"pypi-map":    {"[-json] [-subdirs subdir,...]: export the mapping between PyPI distributions and conda packages as TSV", exportPypiMap},
+	"provides":    {"[-json] [-subdirs subdir,...] pkgconfig|cmake|header name...: list packages that provide pkg-config modules, CMake packages or headers", findBuildProvides},
+	"query":       {"[-json] [-channels channel,...] [-subdirs subdir,...] [-basename|-glob] path...: list packages that own files", queryFiles},
+	"executables": {"[-json] [-subdirs subdir,...] [command...]: export the commands run by the executables of packages, e.g. for command-not-found handlers, as TSV", exportExecutables},
+}
+
+// runCommand runs the subcommand named by args[0] and returns the exit code.
+func runCommand(svr *domain.CondaServer, args []string) int {
+	logger := helpers.GetAppLogger()
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Commands:\n", args[0])
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+		}
+		return ERR_COMMAND
+	}
+
+	if err := cmd.run(svr, args[1:]); err != nil {
+		logger.Printf("[ERROR] Command %s failed: %s", args[0], err.Error())
+		return ERR_COMMAND
+	}
+	return ERR_NONE
+}
+
+// printJson prints v to stdout as indented JSON.
+func printJson(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// newCommandFlagSet returns the flag set of the command name, with the -json flag that every command has for
+// printing its results, as described by what, as JSON rather than as a table.
+func newCommandFlagSet(name string, what string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "Print the "+what+" as a JSON array")
+	return fs, asJson
+}
+
+// walkSubdirs calls fn, in lexical order, for the working directory of every subdir of svr that matches filters
+// along with the relative location of the subdir.
+func walkSubdirs(svr *domain.CondaServer, filters []string, fn func(relativeLocation string, workDir string) error) error {
+	return indexer.WalkSubdirWorkdirs(svr.Workdir, func(relativeLocation string, workDir string) error {
+		if !matchesSubdirFilters(relativeLocation, filters) {
+			return nil
+		}
+		return fn(relativeLocation, workDir)
+	})
+}
+
+// printResults prints results, a slice, to stdout: as a JSON array with asJson, and otherwise as a table with
+// header whose rows are the columns of every result. Tables are aligned to be read, unless tsv is set for them
+// to be exported as tab-separated values.
+func printResults(results interface{}, asJson bool, tsv bool, header []string, columns func(i int) []string) error {
+	v := reflect.ValueOf(results)
+	if asJson {
+		if v.IsNil() {
+			results = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+		}
+		return printJson(results)
+	}
+
+	var w interface {
+		io.Writer
+		Flush() error
+	}
+	if tsv {
+		w = bufio.NewWriter(os.Stdout)
+	} else {
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for i := 0; i < v.Len(); i++ {
+		fmt.Fprintln(w, strings.Join(columns(i), "\t"))
+	}
+	return w.Flush()
+}
+
+// subdirsFlag adds the -subdirs flag, which restricts a command to some subdirs, to fs. The subdir filters
+// are returned once fs is parsed.
+func subdirsFlag(fs *flag.FlagSet) func() []string {
+	subdirs := fs.String("subdirs", "", "Comma-separated subdirs to look in, instead of all of them, by location (e.g. main/linux-64) or name (e.g. linux-64)")
+	return func() []string {
+		if *subdirs == "" {
+			return nil
+		}
+		return strings.Split(*subdirs, ",")
+	}
+}
+
+// channelsFlag adds the -channels flag, which restricts a command to the subdirs of some channels, to fs. The
+// channels are looked up by name among those of svr, and returned as subdir filters once fs is parsed. Channels
+// that are not configured, such as discovered ones, are taken to be relative locations.
+func channelsFlag(fs *flag.FlagSet, svr *domain.CondaServer) func() []string {
+	channels := fs.String("channels", "", "Comma-separated channels to look in, instead of all of them")
+	return func() []string {
+		if *channels == "" {
+			return nil
+		}
+		var res []string
+		for _, name := range strings.Split(*channels, ",") {
+			location := name
+			for key, ch := range svr.Channels {
+				if key == name || ch.Name == name {
+					location = ch.RelativeLocation
+					break
+				}
+			}
+			res = append(res, location)
+		}
+		return res
+	}
+}
+
+// matchesSubdirFilters tells if the subdir at relativeLocation is one of filters, or inside one of them. Filters
+// that are a single path element, such as linux-64, also match the subdirs of that name in every channel. Every
+// subdir matches if there are no filters.
+func matchesSubdirFilters(relativeLocation string, filters []string) bool {
+	if len(filters) == 0 || matchesLocationFilters(relativeLocation, filters) {
+		return true
+	}
+	for _, filter := range filters {
+		filter = filepath.Clean(filter)
+		if !strings.ContainsRune(filter, filepath.Separator) && filepath.Base(relativeLocation) == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLocationFilters tells if the subdir at relativeLocation is one of the locations in filters, or inside
+// one of them. Every subdir matches if there are no filters.
+func matchesLocationFilters(relativeLocation string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		filter = filepath.Clean(filter)
+		if relativeLocation == filter || strings.HasPrefix(relativeLocation, filter+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// subdirFailure is a failure ledger entry along with the subdir and package it is about.
+type subdirFailure struct {
+	Subdir  string `json:"subdir"`
+	Package string `json:"package"`
+	domain.PackageFailure
+}
+
+func listFailures(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("failures", "failures")
+	poisonedOnly := fs.Bool("poisoned", false, "Only list packages that are no longer retried")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var failures []subdirFailure
+	err := walkSubdirs(svr, fs.Args(), func(relativeLocation string, workDir string) error {
+		ledger, err := indexer.ReadSubdirFailures(workDir)
+		if err != nil {
+			return err
+		}
+		for name, failure := range ledger.Failures {
+			if *poisonedOnly && !failure.Poisoned {
+				continue
+			}
+			failures = append(failures, subdirFailure{relativeLocation, name, failure})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Subdir != failures[j].Subdir {
+			return failures[i].Subdir < failures[j].Subdir
+		}
+		return failures[i].Package < failures[j].Package
+	})
+
+	header := []string{"SUBDIR", "PACKAGE", "CLASS", "ATTEMPTS", "FIRST", "LAST", "NEXT_RETRY", "STATE", "ERROR"}
+	return printResults(failures, *asJson, false, header, func(i int) []string {
+		f := failures[i]
+		state, nextRetry := "retrying", f.NextRetry.Format(time.RFC3339)
+		if f.Poisoned {
+			state, nextRetry = "poisoned", "-"
+		}
+		return []string{f.Subdir, f.Package, f.Class, strconv.Itoa(f.Attempts),
+			f.FirstFailure.Format(time.RFC3339), f.LastFailure.Format(time.RFC3339), nextRetry, state, f.Error}
+	})
+}
+
+// subdirSymbolMatch is an exported symbol along with the subdir of the package it is in.
+type subdirSymbolMatch struct {
+	Subdir string `json:"subdir"`
+	indexer.SymbolMatch
+}
+
+func findSymbols(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("symbols", "matches")
+	subdirFilters := subdirsFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no symbols given")
+	}
+	filters := subdirFilters()
+
+	var matches []subdirSymbolMatch
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		for _, arg := range fs.Args() {
+			// Versions are given as in symbol@version or, for the default version, symbol@@version
+			name, version := arg, ""
+			if i := strings.Index(arg, "@"); i > 0 {
+				name, version = arg[:i], strings.TrimLeft(arg[i:], "@")
+			}
+			found, err := indexer.FindSubdirSymbols(workDir, name, version)
+			if err != nil {
+				return err
+			}
+			for _, m := range found {
+				matches = append(matches, subdirSymbolMatch{relativeLocation, m})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return printResults(matches, *asJson, false, []string{"SUBDIR", "PACKAGE", "SYMBOL", "VERSION", "LIBRARY"}, func(i int) []string {
+		m := matches[i]
+		version := m.Version
+		if version == "" {
+			version = "-"
+		}
+		return []string{m.Subdir, m.Package, m.Symbol, version, m.Library}
+	})
+}
+
+// subdirPythonModuleMatch is a package that a Python import loads a module of, along with its subdir.
+type subdirPythonModuleMatch struct {
+	Subdir string `json:"subdir"`
+	Import string `json:"import"`
+	indexer.PythonModuleMatch
+}
+
+func findPythonImports(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("modules", "matches")
+	subdirFilters := subdirsFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no imports given")
+	}
+	filters := subdirFilters()
+
+	var matches []subdirPythonModuleMatch
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		for _, arg := range fs.Args() {
+			found, err := indexer.FindSubdirPythonImport(workDir, arg)
+			if err != nil {
+				return err
+			}
+			for _, m := range found {
+				matches = append(matches, subdirPythonModuleMatch{relativeLocation, arg, m})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	header := []string{"IMPORT", "SUBDIR", "PACKAGE", "NAME", "VERSION", "BUILD", "MODULE"}
+	return printResults(matches, *asJson, false, header, func(i int) []string {
+		m := matches[i]
+		return []string{m.Import, m.Subdir, m.Package, m.Name, m.Version, m.Build, m.Module}
+	})
+}
+
+// subdirPypiMapping is a Python distribution installed by a conda package, along with the subdir of the package.
+type subdirPypiMapping struct {
+	Subdir string `json:"subdir"`
+	indexer.PypiMapping
+}
+
+func exportPypiMap(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("pypi-map", "mapping")
+	subdirFilters := subdirsFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filters := subdirFilters()
+
+	var mappings []subdirPypiMapping
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		found, err := indexer.ReadSubdirPypiMappings(workDir)
+		if err != nil {
+			return err
+		}
+		for _, m := range found {
+			mappings = append(mappings, subdirPypiMapping{relativeLocation, m})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return mappings[i].PypiNormalizedName < mappings[j].PypiNormalizedName
+	})
+
+	header := []string{"pypi_normalized_name", "pypi_name", "pypi_version", "conda_name", "conda_version", "conda_build", "subdir", "package"}
+	return printResults(mappings, *asJson, true, header, func(i int) []string {
+		m := mappings[i]
+		return []string{m.PypiNormalizedName, m.PypiName, m.PypiVersion, m.CondaName, m.CondaVersion, m.CondaBuild, m.Subdir, m.Package}
+	})
+}
+
+// subdirProvideMatch is a package that provides something to builds, along with its subdir.
+type subdirProvideMatch struct {
+	Subdir  string `json:"subdir"`
+	Kind    string `json:"kind"`
+	Provide string `json:"provide"`
+	indexer.ProvideMatch
+}
+
+func findBuildProvides(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("provides", "matches")
+	subdirFilters := subdirsFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("no kind and names given")
+	}
+	filters := subdirFilters()
+	kind, names := fs.Arg(0), fs.Args()[1:]
+
+	var matches []subdirProvideMatch
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		for _, name := range names {
+			found, err := indexer.FindSubdirBuildProvides(workDir, kind, name)
+			if err != nil {
+				return err
+			}
+			for _, m := range found {
+				matches = append(matches, subdirProvideMatch{relativeLocation, kind, name, m})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	header := []string{"PROVIDE", "SUBDIR", "PACKAGE", "NAME", "VERSION", "BUILD", "PATH"}
+	return printResults(matches, *asJson, false, header, func(i int) []string {
+		m := matches[i]
+		return []string{m.Provide, m.Subdir, m.Package, m.Name, m.Version, m.Build, m.Path}
+	})
+}
+
+// subdirExecutable is an executable of a package, along with its subdir and the platform of the subdir.
+type subdirExecutable struct {
+	Subdir   string `json:"subdir"`
+	Platform string `json:"platform"`
+	indexer.Executable
+}
+
+func exportExecutables(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("executables", "executables")
+	subdirFilters := subdirsFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filters := subdirFilters()
+
+	var executables []subdirExecutable
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		found, err := indexer.ReadSubdirExecutables(workDir, fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, e := range found {
+			executables = append(executables, subdirExecutable{relativeLocation, filepath.Base(relativeLocation), e})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(executables, func(i, j int) bool {
+		return executables[i].Command < executables[j].Command
+	})
+
+	return printResults(executables, *asJson, true, []string{"command", "platform", "subdir", "name", "package", "path"}, func(i int) []string {
+		e := executables[i]
+		return []string{e.Command, e.Platform, e.Subdir, e.Name, e.Package, e.Path}
+	})
+}
+
+// subdirFileMatch is a file of a package that matched a query, along with the subdir of the package.
+type subdirFileMatch struct {
+	Subdir string `json:"subdir"`
+	indexer.FileMatch
+}
+
+func queryFiles(svr *domain.CondaServer, args []string) error {
+	fs, asJson := newCommandFlagSet("query", "matches")
+	channelFilters := channelsFlag(fs, svr)
+	subdirFilters := subdirsFlag(fs)
+	byBasename := fs.Bool("basename", false, "Match the base names of files, e.g. libz.so, rather than their paths")
+	byGlob := fs.Bool("glob", false, "Match the paths of files against globs, where ** matches any number of directories")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no paths given")
+	}
+	if *byBasename && *byGlob {
+		return fmt.Errorf("-basename and -glob cannot be used together")
+	}
+	by := indexer.FileMatchPath
+	if *byBasename {
+		by = indexer.FileMatchBasename
+	} else if *byGlob {
+		by = indexer.FileMatchGlob
+	}
+	channels, filters := channelFilters(), subdirFilters()
+
+	var matches []subdirFileMatch
+	err := walkSubdirs(svr, filters, func(relativeLocation string, workDir string) error {
+		if !matchesLocationFilters(relativeLocation, channels) {
+			return nil
+		}
+		found, err := indexer.FindSubdirFiles(workDir, by, fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, m := range found {
+			matches = append(matches, subdirFileMatch{relativeLocation, m})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return printResults(matches, *asJson, false, []string{"QUERY", "ID", "NAME", "VERSION", "BUILD", "PATH"}, func(i int) []string {
+		m := matches[i]
+		return []string{m.Query, m.Id, m.Name, m.Version, m.Build, m.Path}
+	})
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
 	"conda-rlookup/utils"
 	"encoding/json"
 	"fmt"
@@ -60,6 +61,48 @@ var appCfg = AppConfig{
 		RepodataLockMaxWaitSeconds:       181,
 		RepodataLockRetryIntervalSeconds: 2,
 
+		HttpTimeoutSeconds:      60,
+		HttpMaxRetries:          3,
+		HttpRetryBackoffSeconds: 2,
+
+		S3: domain.S3Config{
+			Endpoint:           "https://s3.amazonaws.com",
+			Region:             "us-east-1",
+			AccessKeyIdEnv:     "AWS_ACCESS_KEY_ID",
+			SecretAccessKeyEnv: "AWS_SECRET_ACCESS_KEY",
+			SessionTokenEnv:    "AWS_SESSION_TOKEN",
+		},
+
+		Indexer: domain.IndexerConfig{
+			CondaRangeExtraction: domain.RangeExtractionOff,
+			RepodataCompressions: []string{".zst", ".bz2", ""},
+			Jlap:                 "false",
+			ShardedRepodata:      "false",
+			SkipUnchanged:        "true",
+			PackageWorkers:       1,
+			CheckpointPackages:   500,
+			CheckpointSeconds:    300,
+
+			FailureBackoffSeconds: 3600,
+			FailureMaxAttempts:    5,
+
+			DeepScan:             "false",
+			DeepScanMaxFileBytes: 256 << 20,
+			ExportedSymbols:      "false",
+			PypiNames:            "false",
+			BuildProvides:        "false",
+
+			ApplyPatchInstructions: "false",
+			RevokedPackages:        domain.RevokedPackagesFlag,
+		},
+
+		Discovery: domain.DiscoveryConfig{
+			Enabled:  "false",
+			MaxDepth: 3,
+		},
+
+		SubdirConcurrency: 1,
+
 		Workdir:  "workdir",
 		Channels: map[string]domain.Channel{},
 	},
@@ -96,7 +139,60 @@ func ReadConfigFromFile(filename string) error {
 	}
 
 	// Merge configuration
-	return SetAppConfig(&cfgData)
+	if err = SetAppConfig(&cfgData); err != nil {
+		return err
+	}
+	if err = validateIndexerConfig(appCfg.Server.Indexer); err != nil {
+		return err
+	}
+	for channelName, channel := range appCfg.Server.Channels {
+		for subdirName, subdir := range channel.Subdirs {
+			if err = validateInfoFileSpecs(subdir.InfoFiles); err != nil {
+				return fmt.Errorf("subdir %s of channel %s: %s", subdirName, channelName, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// validateIndexerConfig rejects indexer settings that would otherwise only misbehave once indexing is under way.
+func validateIndexerConfig(cfg domain.IndexerConfig) error {
+	if cfg.DeepScanMaxFileBytes <= 0 {
+		return fmt.Errorf("deep_scan_max_file_bytes must be positive, not %d", cfg.DeepScanMaxFileBytes)
+	}
+	switch cfg.CondaRangeExtraction {
+	case domain.RangeExtractionOff, domain.RangeExtractionTrust, domain.RangeExtractionPublished:
+	default:
+		return fmt.Errorf("conda_range_extraction must be one of %s, %s or %s, not %q",
+			domain.RangeExtractionOff, domain.RangeExtractionTrust, domain.RangeExtractionPublished, cfg.CondaRangeExtraction)
+	}
+	switch strings.ToLower(cfg.RevokedPackages) {
+	case domain.RevokedPackagesFlag, domain.RevokedPackagesDelete:
+	default:
+		return fmt.Errorf("revoked_packages must be %s or %s, not %q",
+			domain.RevokedPackagesFlag, domain.RevokedPackagesDelete, cfg.RevokedPackages)
+	}
+	return validateInfoFileSpecs(cfg.InfoFiles)
+}
+
+// validateInfoFileSpecs rejects info files whose path glob is malformed, and so would never match, or that would
+// fail to be read into every metadata document for their format.
+func validateInfoFileSpecs(specs []domain.InfoFileSpec) error {
+	for _, spec := range specs {
+		if err := helpers.CheckPathGlob(spec.Path); err != nil {
+			return fmt.Errorf("invalid path glob %q of info file: %s", spec.Path, err.Error())
+		}
+		switch spec.Format {
+		case domain.InfoFileFormatRaw, domain.InfoFileFormatJson, domain.InfoFileFormatLines, "":
+		default:
+			return fmt.Errorf("format of info file %s must be one of %s, %s or %s, not %q", spec.Path,
+				domain.InfoFileFormatRaw, domain.InfoFileFormatJson, domain.InfoFileFormatLines, spec.Format)
+		}
+		if spec.Member != "" && spec.Format != domain.InfoFileFormatJson {
+			return fmt.Errorf("info file %s has a member, which only %s files can have", spec.Path, domain.InfoFileFormatJson)
+		}
+	}
+	return nil
 }
 
 // DumpConfigToFile writes application config data to a file as prettified JSON.
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"conda-rlookup/domain"
+	"testing"
+)
+
+func TestValidateIndexerConfigInfoFiles(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		spec  domain.InfoFileSpec
+		valid bool
+	}{
+		{"plain path", domain.InfoFileSpec{Path: "info/about.json", Key: "about", Format: domain.InfoFileFormatJson}, true},
+		{"glob", domain.InfoFileSpec{Path: "info/licenses/**", Key: "licenses"}, true},
+		{"member of json", domain.InfoFileSpec{Path: "info/paths.json", Key: "paths", Format: domain.InfoFileFormatJson, Member: "paths"}, true},
+		{"empty path", domain.InfoFileSpec{Key: "nothing"}, false},
+		{"malformed glob", domain.InfoFileSpec{Path: "info/[licenses/*"}, false},
+		{"malformed element after **", domain.InfoFileSpec{Path: "info/**/\\"}, false},
+		{"unknown format", domain.InfoFileSpec{Path: "info/about.json", Key: "about", Format: "yaml"}, false},
+		{"member of lines", domain.InfoFileSpec{Path: "info/files", Key: "files", Format: domain.InfoFileFormatLines, Member: "paths"}, false},
+		{"member without format", domain.InfoFileSpec{Path: "info/paths.json", Key: "paths", Member: "paths"}, false},
+	} {
+		cfg := appCfg.Server.Indexer
+		cfg.InfoFiles = []domain.InfoFileSpec{tc.spec}
+		if err := validateIndexerConfig(cfg); (err == nil) != tc.valid {
+			t.Errorf("%s: got error %v, want valid %t", tc.desc, err, tc.valid)
+		}
+	}
+}
@@ -1,17 +1,124 @@
 package domain
 
-import "io"
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
 
 type CondaChannelFileSource interface {
 	// GetFile takes a relative location such as "base-ng/linux-64/repodata.json" and
 	// returns a read-closer for it.
 	GetFileReadCloser(string) (io.ReadCloser, error)
+
+	// FileExists takes a relative location and tells if there is a file at it.
+	FileExists(string) (bool, error)
+}
+
+// ErrRangesNotSupported is returned by a CondaChannelRangeFileSource when the file (or the server
+// backing it) cannot be read in parts after all. Callers are expected to fall back to reading it whole.
+var ErrRangesNotSupported = errors.New("byte ranges are not supported by the file source")
+
+// CondaChannelRangeFileSource is a file source that can also serve arbitrary byte ranges of files.
+// It allows reading the few relevant parts of large archives without having to fetch them whole.
+type CondaChannelRangeFileSource interface {
+	CondaChannelFileSource
+
+	// GetFileReaderAt takes a relative location and returns a random access reader
+	// for it along with the size of the file.
+	GetFileReaderAt(string) (ReadAtCloser, int64, error)
+
+	// GetFilePublishedChecksum takes a relative location and a checksum type (sha256 or md5)
+	// and returns the hex-encoded checksum of the file as published by the server, without
+	// reading the file itself.
+	GetFilePublishedChecksum(string, string) (string, error)
+}
+
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// CondaChannelDirLister is a file source that can also list directories, which makes it possible
+// to discover the channels and subdirs it serves.
+type CondaChannelDirLister interface {
+	// ListDirs takes a relative location of a directory ("" being the root of the source) and returns
+	// the names of the directories directly under it.
+	ListDirs(string) ([]string, error)
+}
+
+// CondaChannelFileFingerprinter is a file source that can also tell cheaply whether a file has changed,
+// without reading it.
+type CondaChannelFileFingerprinter interface {
+	// GetFileFingerprint takes a relative location and returns an opaque string, such as an HTTP ETag,
+	// that changes whenever the file does. "" is returned if there is no way to fingerprint the file.
+	GetFileFingerprint(string) (string, error)
 }
 
 // CondaRepodata is a bare-minimum abstraction of the structure of a conda repodata.json file
 // for the purpose of reverse indexing the files in packages.
 type CondaRepodata struct {
-	Packages map[string]CondaPackage `json:"packages"`
+	Packages      map[string]CondaPackage `json:"packages"`
+	PackagesConda map[string]CondaPackage `json:"packages.conda"`
+	Removed       []string                `json:"removed,omitempty"`
+}
+
+// NewCondaRepodata returns an empty repodata with all package maps initialized.
+func NewCondaRepodata() *CondaRepodata {
+	return &CondaRepodata{
+		Packages:      make(map[string]CondaPackage),
+		PackagesConda: make(map[string]CondaPackage),
+	}
+}
+
+// AllPackages returns the entries of both "packages" (.tar.bz2) and "packages.conda" (.conda)
+// in a single map keyed by package filename. Filenames never collide across the two sections
+// since they differ in extension.
+func (r *CondaRepodata) AllPackages() map[string]CondaPackage {
+	res := make(map[string]CondaPackage, len(r.Packages)+len(r.PackagesConda))
+	for name, pkg := range r.Packages {
+		res[name] = pkg
+	}
+	for name, pkg := range r.PackagesConda {
+		res[name] = pkg
+	}
+	return res
+}
+
+// AddPackage adds pkg to "packages.conda" or "packages" depending on the extension of name.
+func (r *CondaRepodata) AddPackage(name string, pkg CondaPackage) {
+	if IsCondaV2Package(name) {
+		if r.PackagesConda == nil {
+			r.PackagesConda = make(map[string]CondaPackage)
+		}
+		r.PackagesConda[name] = pkg
+		return
+	}
+	if r.Packages == nil {
+		r.Packages = make(map[string]CondaPackage)
+	}
+	r.Packages[name] = pkg
+}
+
+// IsCondaV2Package tells if a package filename refers to the newer zip based ".conda" format
+// as opposed to the older ".tar.bz2" one.
+func IsCondaV2Package(name string) bool {
+	return strings.HasSuffix(name, ".conda")
+}
+
+// CondaPatchInstructions is the structure of the patch_instructions.json file of a subdir, which conda-index
+// applies to the repodata generated from the packages (repodata_from_packages.json) to obtain repodata.json.
+type CondaPatchInstructions struct {
+	PatchInstructionsVersion int `json:"patch_instructions_version"`
+
+	// Packages and PackagesConda map package filenames to the fields to be updated in their repodata entry.
+	Packages      map[string]map[string]interface{} `json:"packages"`
+	PackagesConda map[string]map[string]interface{} `json:"packages.conda"`
+
+	// Remove and Revoke list package filenames to be removed from the repodata or marked as revoked.
+	Remove []string `json:"remove"`
+	Revoke []string `json:"revoke"`
 }
 
 // Kafkadocs maps kafka doc json files to their SHA256sum
@@ -24,14 +131,42 @@ type KafkadocEntry struct {
 	Sha256 string `json:"sha256"`
 }
 
+// FailureLedger records the packages of a subdir that could not be indexed, keyed by package filename.
+type FailureLedger struct {
+	Failures map[string]PackageFailure `json:"failures"`
+}
+
+// PackageFailure records the failed attempts at indexing a package with a given checksum. Retries are
+// backed off exponentially, and given up on altogether once the package is poisoned.
+type PackageFailure struct {
+	Class    string `json:"class"`
+	Error    string `json:"error"`
+	Checksum string `json:"checksum"`
+
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"first_failure"`
+	LastFailure  time.Time `json:"last_failure"`
+	NextRetry    time.Time `json:"next_retry"`
+	Poisoned     bool      `json:"poisoned"`
+}
+
+// Classes of package failures
+const (
+	FailureClassFetch    = "fetch"
+	FailureClassExtract  = "extract"
+	FailureClassChecksum = "checksum"
+	FailureClassMetadata = "metadata"
+)
+
 // CondaPackage is a generic abstraction of the "packages" section of a conda repodata.json file.
 // It's structured generically so that we do not have to care about what fields are added or removed
 // in the future as long as the essentially ones are there.
 type CondaPackage map[string]interface{}
 
 // CondaServer stores configuration information about a single conda server.
-// A conda-server is a collection of channels under a single directory (local)
-// or accessible under a base url (remote).
+// A conda-server is a collection of channels under a single directory (local),
+// accessible under a base url (remote), stored in an S3 bucket (when S3.Bucket is set) or
+// mirrored to an OCI registry (when Oci.Registry is set).
 type CondaServer struct {
 	Name string `json:"name"`
 
@@ -41,20 +176,222 @@ type CondaServer struct {
 	RepodataLockMaxWaitSeconds       int    `json:"repodata_lock_max_wait_seconds"`
 	RepodataLockRetryIntervalSeconds int    `json:"repodata_lock_retry_interval_seconds"`
 
+	HttpTimeoutSeconds      int `json:"http_timeout_seconds"`
+	HttpMaxRetries          int `json:"http_max_retries"`
+	HttpRetryBackoffSeconds int `json:"http_retry_backoff_seconds"`
+
+	S3  S3Config  `json:"s3"`
+	Oci OciConfig `json:"oci"`
+
+	// Auth is how to authenticate with a remote conda server; channels can override it
+	Auth Credentials `json:"auth"`
+
+	Indexer   IndexerConfig   `json:"indexer"`
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// SubdirConcurrency is the number of subdirs that are indexed (and flushed to kafka) in parallel
+	SubdirConcurrency int `json:"subdir_concurrency"`
+
 	Workdir string `json:"workdir"`
 
 	Channels map[string]Channel `json:"channels"`
 }
 
+// S3Config stores the location of conda channels in an S3-compatible object store.
+// Credentials are never part of the configuration; only the names of the environment
+// variables to read them from are.
+type S3Config struct {
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix"`
+
+	AccessKeyIdEnv     string `json:"access_key_id_env"`
+	SecretAccessKeyEnv string `json:"secret_access_key_env"`
+	SessionTokenEnv    string `json:"session_token_env"`
+}
+
+// OciConfig stores the location of conda channels mirrored to an OCI registry, such as
+// {"registry": "ghcr.io", "namespace": "channel-mirrors"} for the conda-forge mirror on ghcr.io.
+type OciConfig struct {
+	Registry  string `json:"registry"`
+	Namespace string `json:"namespace"`
+}
+
+// Credentials stores how to authenticate with a remote conda server. Type is one of:
+//   - "token": anaconda.org style, with the token inserted into urls as /t/<token>/ after the base url.
+//   - "basic": HTTP basic authentication with Username and the password.
+//   - "bearer": an "Authorization: Bearer <token>" header.
+//   - "netrc": HTTP basic authentication with the login and password for the server host in NetrcFile
+//     (or $NETRC, or ~/.netrc).
+//
+// An empty Type means no authentication. Secrets are never part of the configuration; only the names of
+// the environment variables or the paths of the files to read them from are. S3 file sources use a basic
+// Username and password as access key id and secret access key, while OCI file sources use basic
+// credentials to obtain registry tokens, and bearer/token credentials as registry tokens.
+type Credentials struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+
+	PasswordEnv  string `json:"password_env"`
+	PasswordFile string `json:"password_file"`
+	TokenEnv     string `json:"token_env"`
+	TokenFile    string `json:"token_file"`
+	NetrcFile    string `json:"netrc_file"`
+}
+
+// Types of credentials
+const (
+	CredentialsToken  = "token"
+	CredentialsBasic  = "basic"
+	CredentialsBearer = "bearer"
+	CredentialsNetrc  = "netrc"
+)
+
+// DiscoveryConfig controls the automatic discovery of the channels and subdirs of a conda server.
+// Every directory up to MaxDepth levels deep that holds repodata is a subdir, and is indexed if its
+// relative location matches one of the Include globs (all do if there are none) but none of the Exclude
+// ones. Discovered subdirs are added to the configured ones; the configured ones take precedence.
+type DiscoveryConfig struct {
+	Enabled  string   `json:"enabled"`
+	MaxDepth int      `json:"max_depth"`
+	Include  []string `json:"include"`
+	Exclude  []string `json:"exclude"`
+}
+
+// Modes for extracting the info section of .conda packages using byte ranges
+// instead of fetching the whole package.
+const (
+	// RangeExtractionOff always fetches and verifies the whole package.
+	RangeExtractionOff = "off"
+	// RangeExtractionTrust fetches only the info section and skips checksum verification.
+	RangeExtractionTrust = "trust"
+	// RangeExtractionPublished fetches only the info section and verifies the checksum
+	// from repodata against the one published by the server for the package.
+	RangeExtractionPublished = "published"
+)
+
+// IndexerConfig stores the settings that control how the subdirs of a conda server are indexed.
+type IndexerConfig struct {
+	CondaRangeExtraction string `json:"conda_range_extraction"`
+
+	// RepodataCompressions lists the suffixes of the repodata variants to look for in
+	// order of preference, such as ".zst", ".bz2" and "" for plain repodata.json.
+	RepodataCompressions []string `json:"repodata_compressions"`
+
+	// Jlap fetches repodata incrementally through the repodata.jlap of each subdir, if there is one.
+	// The repodata is cached in the workdir of the subdir and brought up to date with the patches in it.
+	Jlap string `json:"jlap"`
+
+	// ShardedRepodata reads the repodata of each subdir from its repodata_shards.msgpack.zst (CEP-16), if
+	// there is one. Shards are kept in the workdir of the subdir, and only the ones that changed are fetched.
+	ShardedRepodata string `json:"sharded_repodata"`
+
+	// SkipUnchanged skips subdirs whose repodata (and settings) have not changed since they were last
+	// indexed without failures, going by the fingerprint recorded in their workdirs
+	SkipUnchanged string `json:"skip_unchanged"`
+
+	// PackageWorkers is the number of packages of a subdir that are fetched and extracted in parallel
+	PackageWorkers int `json:"package_workers"`
+
+	// The progress of indexing a subdir is checkpointed every CheckpointPackages updated or failed packages
+	// or CheckpointSeconds seconds, whichever comes first, if any package changed since; 0 disables either
+	CheckpointPackages int `json:"checkpoint_packages"`
+	CheckpointSeconds  int `json:"checkpoint_seconds"`
+
+	// Packages that fail to be indexed are retried after FailureBackoffSeconds, doubling with every
+	// further failure, and are not retried any more after FailureMaxAttempts (unless their checksum changes)
+	FailureBackoffSeconds int `json:"failure_backoff_seconds"`
+	FailureMaxAttempts    int `json:"failure_max_attempts"`
+
+	// ApplyPatchInstructions applies the patch_instructions.json of each subdir to its repodata before indexing
+	ApplyPatchInstructions string `json:"apply_patch_instructions"`
+
+	// RevokedPackages is what to do with revoked packages: flag or delete
+	RevokedPackages string `json:"revoked_packages"`
+
+	// DeepScan looks into all the files of packages as they are extracted, for the sonames ELF shared libraries
+	// provide and need. ELF files larger than DeepScanMaxFileBytes, which must be positive, are passed over, and
+	// the others spooled to temporary files to be looked into.
+	// Looking into all the files, which the settings below may do as well, means fetching and decompressing
+	// whole packages: .conda packages are then never read by range, whatever CondaRangeExtraction says.
+	DeepScan             string `json:"deep_scan"`
+	DeepScanMaxFileBytes int64  `json:"deep_scan_max_file_bytes"`
+
+	// ExportedSymbols keeps the dynamic symbols exported by the ELF shared libraries of packages in a
+	// symbols.tsv.gz file in their directories. It looks into all the files of packages (see DeepScan).
+	ExportedSymbols string `json:"exported_symbols"`
+
+	// PypiNames reads the names and versions of the Python distributions that packages install into
+	// site-packages from their dist-info or egg-info metadata. It looks into all the files of packages (see
+	// DeepScan).
+	PypiNames string `json:"pypi_names"`
+
+	// BuildProvides adds what packages provide to builds against them to their metadata documents: pkg-config
+	// modules (along with the Name and Version in their .pc files), CMake config packages and headers. It looks
+	// into all the files of packages (see DeepScan).
+	BuildProvides string `json:"build_provides"`
+
+	// InfoFiles are the files extracted from packages and how they go into their metadata documents.
+	// If empty, info/about.json, info/index.json, info/files and info/paths.json are extracted.
+	InfoFiles []InfoFileSpec `json:"info_files"`
+}
+
+// InfoFileSpec tells which files to extract from packages and how to put them into their metadata documents.
+type InfoFileSpec struct {
+	// Path is a slash-separated glob of files in the package, such as "info/licenses/**". The element "**"
+	// matches any number of path elements. Only files under info/ are available in .conda packages, unless
+	// all of their files are looked into for some other reason (see DeepScan).
+	Path string `json:"path"`
+
+	// Key is the member of the metadata document the file goes into; if Path is a glob, it is an object
+	// of the contents of each matching file, keyed by its path. Files without a Key are only extracted.
+	Key string `json:"key"`
+
+	// Format is how the file is read: raw, json or lines
+	Format string `json:"format"`
+
+	// Member, for json files, picks a single member of the object in the file instead of the whole object
+	Member string `json:"member,omitempty"`
+}
+
+// Formats of info files
+const (
+	// InfoFileFormatRaw puts the contents of a file as a string.
+	InfoFileFormatRaw = "raw"
+	// InfoFileFormatJson puts the parsed JSON content of a file.
+	InfoFileFormatJson = "json"
+	// InfoFileFormatLines puts the lines of a file as an array of strings.
+	InfoFileFormatLines = "lines"
+)
+
+// Actions for revoked packages
+const (
+	// RevokedPackagesFlag keeps revoked packages in the index, with "revoked" set in their metadata documents.
+	RevokedPackagesFlag = "flag"
+	// RevokedPackagesDelete deletes revoked packages from the index.
+	RevokedPackagesDelete = "delete"
+)
+
 type Channel struct {
 	Name string `json:"name"`
 
 	RelativeLocation string            `json:"relative_location"`
 	Subdirs          map[string]Subdir `json:"subdirs"`
+
+	// Auth, if its Type is set, overrides the credentials of the server for this channel
+	Auth Credentials `json:"auth"`
 }
 
 type Subdir struct {
 	Name             string                 `json:"name"`
 	RelativeLocation string                 `json:"relative_location"`
 	ExtraData        map[string]interface{} `json:"extra_data"`
+
+	// UseRepodataFromPackages indexes repodata_from_packages.json (i.e. repodata without any
+	// patches applied) instead of repodata.json
+	UseRepodataFromPackages string `json:"use_repodata_from_packages"`
+
+	// InfoFiles, if not empty, replaces the InfoFiles of the indexer config for this subdir
+	InfoFiles []InfoFileSpec `json:"info_files"`
 }
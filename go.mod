@@ -6,8 +6,11 @@ require (
 	github.com/gofrs/flock v0.7.1
 	github.com/google/renameio v0.1.0
 	github.com/imdario/mergo v0.3.9
+	github.com/klauspost/compress v1.11.13
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/segmentio/kafka-go v0.3.5
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -1 +1,44 @@
 package helpers
+
+import (
+	"bufio"
+	"conda-rlookup/domain"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PackageExtractFilesAndGetChecksum extracts the allowed-files from a package stream into destDir
+// and returns the checksum of the stream, picking the right archive format from the package filename.
+// Unless visit is nil, the regular files of the package are passed to it on the way.
+// See TarBz2ExtractFilesAndGetChecksum and CondaExtractFilesAndGetChecksum for the details.
+func PackageExtractFilesAndGetChecksum(pkgFilename string, srcReader io.Reader, destDir string, allowedFiles []string, visit TarEntryVisitor, checksumType string) (string, error) {
+	if domain.IsCondaV2Package(pkgFilename) {
+		return CondaExtractFilesAndGetChecksum(srcReader, destDir, allowedFiles, visit, checksumType)
+	}
+	return TarBz2ExtractFilesAndGetChecksum(srcReader, destDir, allowedFiles, visit, checksumType)
+}
+
+// readPublishedChecksumFile reads the checksum of a file from the checksum file published alongside it
+// in src i.e. "<file>.sha256" or "<file>.md5". Both a bare checksum and the "<checksum>  <filename>" format
+// of sha256sum/md5sum are understood.
+func readPublishedChecksumFile(src domain.CondaChannelFileSource, relativeFilepath string, checksumType string) (string, error) {
+	checksumType = strings.ToLower(checksumType)
+	if checksumType != "sha256" && checksumType != "md5" {
+		return "", fmt.Errorf("Unknown checksum type %s: must be one of {sha256, md5}", checksumType)
+	}
+
+	rc, err := src.GetFileReadCloser(relativeFilepath + "." + checksumType)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(rc, 4096))
+	scanner.Split(bufio.ScanWords)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("empty %s checksum file for %s", checksumType, relativeFilepath)
+	}
+
+	return strings.ToLower(scanner.Text()), nil
+}
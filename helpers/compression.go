@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"compress/bzip2"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionSuffixes are the filename suffixes of the compressed variants of files such as repodata.json.
+var compressionSuffixes = []string{".zst", ".bz2"}
+
+// TrimCompressionSuffix returns filename without its compression suffix, if any.
+func TrimCompressionSuffix(filename string) string {
+	for _, suffix := range compressionSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return strings.TrimSuffix(filename, suffix)
+		}
+	}
+	return filename
+}
+
+// NewDecompressingReadCloser returns a reader that decompresses r according to the compression suffix
+// of filename (".zst" or ".bz2"). Files without a compression suffix are passed through as is.
+// Closing the returned reader does not close r.
+func NewDecompressingReadCloser(filename string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".zst"):
+		zstdDecomp, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecomp.IOReadCloser(), nil
+	case strings.HasSuffix(filename, ".bz2"):
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+// IsRepodataFile tells if filename is one of the repodata files that conda-index (re)writes in place,
+// compressed or not. Such files must be read under the repodata lock.
+func IsRepodataFile(filename string) bool {
+	switch TrimCompressionSuffix(filename) {
+	case "repodata.json", "repodata_from_packages.json", "patch_instructions.json":
+		return true
+	}
+	return false
+}
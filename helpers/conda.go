@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CondaExtractFilesAndGetChecksum reads a .conda stream and tries extracting a set of "allowed-files"
+// from the info-*.tar.zst member of the archive into destDir while also trying to calculate the checksum
+// (sha256 or md5) of the whole stream. The checksum is returned as a hex-encoded string, along with error, if any.
+// Since a .conda file is a zip archive, whose index lives at its very end, the stream is spooled to a
+// temporary file in destDir while hashing, and removed once the extraction is over.
+// Unless visit is nil, every regular file in both the info-*.tar.zst and the pkg-*.tar.zst members of the
+// archive is passed to it.
+// destDir is created if it does not already exist.
+// If there are no errors, srcReader is guaranteed to be read till EOF.
+// In case of errors, the state of destDir is unknown.
+func CondaExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allowedFiles []string, visit TarEntryVisitor, checksumType string) (string, error) {
+	logger := GetAppLogger()
+
+	hasher, err := newHasher(checksumType)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(destDir, 0755); err != nil {
+		return "", logger.ErrorPrintf("could not create dir %s: %s", destDir, err.Error())
+	}
+
+	spoolFile, err := ioutil.TempFile(destDir, ".tmp.package.conda.*")
+	if err != nil {
+		return "", logger.ErrorPrintf("could not create tempfile for spooling package: %s", err.Error())
+	}
+	defer os.Remove(spoolFile.Name())
+	defer spoolFile.Close()
+
+	size, err := io.Copy(io.MultiWriter(spoolFile, hasher), srcReader)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not spool package to tempfile %s: %s", spoolFile.Name(), err.Error())
+	}
+
+	if err = condaExtractMembers(spoolFile, size, destDir, allowedFiles, visit); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// CondaExtractInfoFiles opens the .conda (zip) archive of the given size that can be read from ra, and
+// extracts the allowed-files present in its info-*.tar.zst member into destDir.
+// Only the zip central directory and the info member are ever read from ra.
+func CondaExtractInfoFiles(ra io.ReaderAt, size int64, destDir string, allowedFiles []string) error {
+	return condaExtractMembers(ra, size, destDir, allowedFiles, nil)
+}
+
+// condaExtractMembers extracts the allowed-files present in the info-*.tar.zst member of the .conda archive
+// of the given size that can be read from ra into destDir. Unless visit is nil, the pkg-*.tar.zst member is
+// read as well: its allowed-files are extracted too, and the regular files of both members are passed to visit.
+func condaExtractMembers(ra io.ReaderAt, size int64, destDir string, allowedFiles []string, visit TarEntryVisitor) error {
+	logger := GetAppLogger()
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return logger.ErrorPrintf("could not read .conda archive: %s", err.Error())
+	}
+
+	var infoMember, pkgMember *zip.File
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if !strings.HasSuffix(name, ".tar.zst") {
+			continue
+		}
+		if strings.HasPrefix(name, "info-") && infoMember == nil {
+			infoMember = f
+		} else if strings.HasPrefix(name, "pkg-") && pkgMember == nil {
+			pkgMember = f
+		}
+	}
+	if infoMember == nil {
+		return logger.ErrorPrintf("could not find an info-*.tar.zst member in .conda archive")
+	}
+
+	if err = condaExtractMember(infoMember, destDir, allowedFiles, visit); err != nil {
+		return err
+	}
+	if visit != nil && pkgMember != nil {
+		return condaExtractMember(pkgMember, destDir, allowedFiles, visit)
+	}
+	return nil
+}
+
+// condaExtractMember extracts the allowed-files of the tar.zst member m of a .conda archive into destDir,
+// passing its regular files to visit unless it is nil.
+func condaExtractMember(m *zip.File, destDir string, allowedFiles []string, visit TarEntryVisitor) error {
+	logger := GetAppLogger()
+
+	mr, err := m.Open()
+	if err != nil {
+		return logger.ErrorPrintf("could not open member %s of .conda archive: %s", m.Name, err.Error())
+	}
+	defer mr.Close()
+
+	zstdDecomp, err := zstd.NewReader(mr)
+	if err != nil {
+		return logger.ErrorPrintf("could not decompress member %s of .conda archive: %s", m.Name, err.Error())
+	}
+	defer zstdDecomp.Close()
+
+	return extractAllowedFilesFromTar(tar.NewReader(zstdDecomp), destDir, allowedFiles, visit)
+}
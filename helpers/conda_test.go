@@ -0,0 +1,197 @@
+package helpers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// condaArchive returns a .conda archive with a member for each of members, by name: a zstd-compressed tarball
+// of its files, by path, for the names ending in .tar.zst, and the JSON metadata of the archive otherwise.
+func condaArchive(t *testing.T, members map[string]map[string]string) []byte {
+	var names []string
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, ".tar.zst") {
+			if _, err = io.WriteString(w, `{"conda_pkg_format_version": 2}`); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(enc)
+		for path, data := range members[name] {
+			if err = tw.WriteHeader(&tar.Header{Name: path, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.WriteString(tw, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractedFiles returns the contents of the files under dir, by slash-separated path.
+func extractedFiles(t *testing.T, dir string) map[string]string {
+	res := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		res[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestCondaExtractFilesAndGetChecksum(t *testing.T) {
+	pkg := condaArchive(t, map[string]map[string]string{
+		"metadata.json": nil,
+		"info-foo-1.0-0.tar.zst": {
+			"info/index.json":       `{"name": "foo"}`,
+			"info/about.json":       `{}`,
+			"info/licenses/LICENSE": "MIT",
+		},
+		"pkg-foo-1.0-0.tar.zst": {
+			"bin/foo":          "#!/bin/sh",
+			"lib/libfoo.so.1":  "\x7fELF",
+			"share/doc/README": "foo",
+		},
+	})
+	sum := sha256.Sum256(pkg)
+	allowedFiles := []string{"info/index.json", "info/licenses/**", "lib/*"}
+
+	for _, tc := range []struct {
+		desc    string
+		visit   bool
+		files   map[string]string
+		visited []string
+	}{
+		{
+			// The pkg member is not even read, so its allowed-files are not extracted either
+			"info member only",
+			false,
+			map[string]string{"info/index.json": `{"name": "foo"}`, "info/licenses/LICENSE": "MIT"},
+			nil,
+		},
+		{
+			"both members",
+			true,
+			map[string]string{"info/index.json": `{"name": "foo"}`, "info/licenses/LICENSE": "MIT", "lib/libfoo.so.1": "\x7fELF"},
+			[]string{"bin/foo", "info/about.json", "info/index.json", "info/licenses/LICENSE", "lib/libfoo.so.1", "share/doc/README"},
+		},
+	} {
+		destDir := t.TempDir()
+		var visited []string
+		var visit TarEntryVisitor
+		if tc.visit {
+			visit = func(name string, header *tar.Header, r io.Reader) error {
+				visited = append(visited, name)
+				return nil
+			}
+		}
+
+		checksum, err := CondaExtractFilesAndGetChecksum(bytes.NewReader(pkg), destDir, allowedFiles, visit, "sha256")
+		if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		if checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: got checksum %s, want %s", tc.desc, checksum, hex.EncodeToString(sum[:]))
+		}
+		// The package spooled while hashing is gone too
+		if got := extractedFiles(t, destDir); !reflect.DeepEqual(got, tc.files) {
+			t.Errorf("%s: got files %v, want %v", tc.desc, got, tc.files)
+		}
+		sort.Strings(visited)
+		if !reflect.DeepEqual(visited, tc.visited) {
+			t.Errorf("%s: got files visited %v, want %v", tc.desc, visited, tc.visited)
+		}
+	}
+}
+
+func TestCondaExtractInfoFiles(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		members map[string]map[string]string
+		files   map[string]string
+	}{
+		{
+			"info and pkg members",
+			map[string]map[string]string{
+				"info-foo-1.0-0.tar.zst": {"info/index.json": `{"name": "foo"}`, "info/about.json": `{}`},
+				"pkg-foo-1.0-0.tar.zst":  {"info/index.json": "not the info member", "bin/foo": "#!/bin/sh"},
+			},
+			map[string]string{"info/index.json": `{"name": "foo"}`},
+		},
+		{
+			"no info member",
+			map[string]map[string]string{"pkg-foo-1.0-0.tar.zst": {"info/index.json": `{}`}},
+			nil,
+		},
+	} {
+		pkg := condaArchive(t, tc.members)
+		destDir := t.TempDir()
+		err := CondaExtractInfoFiles(bytes.NewReader(pkg), int64(len(pkg)), destDir, []string{"info/index.json", "bin/*"})
+		if tc.files == nil {
+			if err == nil {
+				t.Errorf("%s: got no error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		if got := extractedFiles(t, destDir); !reflect.DeepEqual(got, tc.files) {
+			t.Errorf("%s: got files %v, want %v", tc.desc, got, tc.files)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package helpers
+
+import (
+	"bufio"
+	"conda-rlookup/domain"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// httpAuth holds credentials resolved from a domain.Credentials, secrets included.
+type httpAuth struct {
+	kind     string
+	username string
+	password string
+	token    string
+}
+
+// resolveCredentials reads the secrets of c from the environment or files. host is the host of the
+// server, which netrc credentials are looked up for.
+func resolveCredentials(c domain.Credentials, host string) (httpAuth, error) {
+	auth := httpAuth{kind: c.Type, username: c.Username}
+
+	var err error
+	switch c.Type {
+	case "":
+	case domain.CredentialsBasic:
+		if auth.password, err = readSecret("password", c.PasswordEnv, c.PasswordFile); err != nil {
+			return auth, err
+		}
+	case domain.CredentialsToken, domain.CredentialsBearer:
+		if auth.token, err = readSecret("token", c.TokenEnv, c.TokenFile); err != nil {
+			return auth, err
+		}
+		if auth.token == "" {
+			return auth, fmt.Errorf("empty token for %s credentials", c.Type)
+		}
+	case domain.CredentialsNetrc:
+		netrcFile := c.NetrcFile
+		if netrcFile == "" {
+			netrcFile = os.Getenv("NETRC")
+		}
+		if netrcFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return auth, fmt.Errorf("could not locate netrc file: %s", err.Error())
+			}
+			netrcFile = filepath.Join(home, ".netrc")
+		}
+		found := false
+		if auth.username, auth.password, found, err = lookupNetrc(netrcFile, host); err != nil {
+			return auth, err
+		}
+		if !found {
+			return auth, fmt.Errorf("no credentials for host %s in netrc file %s", host, netrcFile)
+		}
+		auth.kind = domain.CredentialsBasic
+	default:
+		return auth, fmt.Errorf("unsupported credentials type %q: must be one of {%s, %s, %s, %s}", c.Type,
+			domain.CredentialsToken, domain.CredentialsBasic, domain.CredentialsBearer, domain.CredentialsNetrc)
+	}
+
+	return auth, nil
+}
+
+// apply sets the header that authenticates req, for basic and bearer credentials.
+func (a httpAuth) apply(req *http.Request) {
+	switch a.kind {
+	case domain.CredentialsBasic:
+		req.SetBasicAuth(a.username, a.password)
+	case domain.CredentialsBearer:
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+}
+
+// readSecret returns the value of environment variable env if set, or else the contents of file
+// with surrounding whitespace trimmed.
+func readSecret(what string, env string, file string) (string, error) {
+	if env != "" {
+		if val, ok := os.LookupEnv(env); ok {
+			return val, nil
+		}
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s file %s: %s", what, file, err.Error())
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if env != "" {
+		return "", fmt.Errorf("environment variable %s for the %s is not set", env, what)
+	}
+
+	return "", fmt.Errorf("neither an environment variable nor a file is configured for the %s", what)
+}
+
+// lookupNetrc returns the login and password for host from the netrc file at netrcFile, falling back to
+// its "default" entry. Macros are not supported.
+func lookupNetrc(netrcFile string, host string) (login string, password string, found bool, err error) {
+	f, err := os.Open(netrcFile)
+	if err != nil {
+		return "", "", false, fmt.Errorf("could not open netrc file %s: %s", netrcFile, err.Error())
+	}
+	defer f.Close()
+
+	type netrcEntry struct {
+		machine, login, password string
+		isDefault                bool
+	}
+
+	var entries []*netrcEntry
+	var cur *netrcEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			cur = &netrcEntry{}
+			entries = append(entries, cur)
+			if scanner.Scan() {
+				cur.machine = scanner.Text()
+			}
+		case "default":
+			cur = &netrcEntry{isDefault: true}
+			entries = append(entries, cur)
+		case "login":
+			if scanner.Scan() && cur != nil {
+				cur.login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() && cur != nil {
+				cur.password = scanner.Text()
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", "", false, fmt.Errorf("could not read netrc file %s: %s", netrcFile, err.Error())
+	}
+
+	var def *netrcEntry
+	for _, e := range entries {
+		if e.isDefault && def == nil {
+			def = e
+		} else if !e.isDefault && e.machine == host {
+			return e.login, e.password, true, nil
+		}
+	}
+	if def != nil {
+		return def.login, def.password, true, nil
+	}
+
+	return "", "", false, nil
+}
@@ -0,0 +1,82 @@
+package helpers
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+)
+
+// elfMagic is what every ELF file starts with.
+var elfMagic = []byte(elf.ELFMAG)
+
+// IsElfHeader tells if the given leading bytes of a file are those of an ELF file.
+func IsElfHeader(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, elfMagic)
+}
+
+// ElfDynamicInfo is what the dynamic section of an ELF file tells about it.
+type ElfDynamicInfo struct {
+	// Soname is "" for files that are not shared libraries
+	Soname string
+	Needed []string
+
+	// SharedObject tells if the file is position-independent (a shared library or a PIE executable)
+	SharedObject bool
+
+	// Exported are the defined global and weak dynamic symbols, if asked for
+	Exported []ElfSymbol
+}
+
+// ElfSymbol is a dynamic symbol along with its version, which is "" for unversioned symbols.
+type ElfSymbol struct {
+	Name    string
+	Version string
+}
+
+// ReadElfDynamicInfo reads the dynamic section of the ELF file in r and, if withSymbols is set, its exported
+// dynamic symbols. Everything is left empty for statically linked files.
+func ReadElfDynamicInfo(r io.ReaderAt, withSymbols bool) (*ElfDynamicInfo, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := ElfDynamicInfo{SharedObject: f.Type == elf.ET_DYN}
+	if f.Section(".dynamic") == nil {
+		return &res, nil
+	}
+
+	sonames, err := f.DynString(elf.DT_SONAME)
+	if err != nil {
+		return nil, err
+	}
+	if len(sonames) > 0 {
+		res.Soname = sonames[0]
+	}
+
+	if res.Needed, err = f.DynString(elf.DT_NEEDED); err != nil {
+		return nil, err
+	}
+
+	if withSymbols {
+		syms, err := f.DynamicSymbols()
+		if err != nil && err != elf.ErrNoSymbols {
+			return nil, err
+		}
+		for _, sym := range syms {
+			if sym.Section == elf.SHN_UNDEF || sym.Name == "" {
+				continue
+			}
+			if bind := elf.ST_BIND(sym.Info); bind != elf.STB_GLOBAL && bind != elf.STB_WEAK {
+				continue
+			}
+			switch elf.ST_TYPE(sym.Info) {
+			case elf.STT_FUNC, elf.STT_OBJECT, elf.STT_TLS, elf.STT_GNU_IFUNC:
+				res.Exported = append(res.Exported, ElfSymbol{Name: sym.Name, Version: sym.Version})
+			}
+		}
+	}
+
+	return &res, nil
+}
@@ -0,0 +1,53 @@
+package helpers
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPathGlob tells if the slash-separated path name matches pattern. pattern is matched element by
+// element as by path.Match, except that an element "**" matches any number of path elements, including none.
+// A malformed pattern matches nothing; see CheckPathGlob.
+func MatchPathGlob(pattern string, name string) bool {
+	return matchPathElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchPathElements(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchPathElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// CheckPathGlob returns path.ErrBadPattern if pattern is malformed, i.e. if any of its elements is, or if it is
+// empty, and nil otherwise.
+func CheckPathGlob(pattern string) error {
+	if pattern == "" {
+		return path.ErrBadPattern
+	}
+	for _, element := range strings.Split(pattern, "/") {
+		if _, err := path.Match(element, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsPathGlob tells if pattern has any glob metacharacters, i.e. whether it can match more than one path.
+func IsPathGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
@@ -0,0 +1,463 @@
+package helpers
+
+import (
+	"conda-rlookup/domain"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpFileSource serves conda channel files from a remote conda server over HTTP(S).
+// Every relative file location is resolved against BaseUrl, and responses are handed out
+// as streams so that packages can be hashed and extracted on the fly without being spooled
+// to disk first. Requests are authenticated with Credentials, if set.
+type HttpFileSource struct {
+	BaseUrl             string
+	Credentials         domain.Credentials
+	TimeoutSeconds      int
+	MaxRetries          int
+	RetryBackoffSeconds int
+
+	Client *http.Client
+
+	baseUrl *url.URL
+	auth    httpAuth
+
+	// prepareRequest, if set, is called on every request before it is sent; e.g. for signing it.
+	prepareRequest func(*http.Request) error
+}
+
+func (h *HttpFileSource) Init() error {
+	logger := GetAppLogger()
+
+	if h == nil {
+		return logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	u, err := url.Parse(h.BaseUrl)
+	if err != nil {
+		return logger.ErrorPrintf("could not parse base url %s: %s", h.BaseUrl, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return logger.ErrorPrintf("unsupported scheme in base url %s: must be one of {http, https}", h.BaseUrl)
+	}
+	h.baseUrl = u
+
+	if h.auth, err = resolveCredentials(h.Credentials, u.Hostname()); err != nil {
+		return logger.ErrorPrintf("could not resolve credentials for %s: %s", h.BaseUrl, err.Error())
+	}
+
+	if h.TimeoutSeconds < 1 {
+		h.TimeoutSeconds = 60
+	}
+
+	if h.MaxRetries < 0 {
+		h.MaxRetries = 0
+	}
+
+	if h.RetryBackoffSeconds < 1 {
+		h.RetryBackoffSeconds = 1
+	}
+
+	if h.Client == nil {
+		timeout := time.Duration(h.TimeoutSeconds) * time.Second
+		h.Client = &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   timeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConnsPerHost:   4,
+			},
+		}
+	}
+
+	return nil
+}
+
+// GetFileUrl returns the absolute url of a file given its location relative to the base url.
+func (h *HttpFileSource) GetFileUrl(relativeFilepath string) string {
+	u := *h.baseUrl
+	u.Path = path.Join(u.Path, filepath.ToSlash(relativeFilepath))
+	return u.String()
+}
+
+func (h *HttpFileSource) GetFileReadCloser(relativeFilepath string) (io.ReadCloser, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return nil, logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	fileUrl := h.GetFileUrl(relativeFilepath)
+	resp, cancel, err := h.do(http.MethodGet, fileUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not fetch %s: %s", fileUrl, err.Error())
+	}
+
+	return newIdleTimeoutReadCloser(resp.Body, cancel, time.Duration(h.TimeoutSeconds)*time.Second), nil
+}
+
+// FileExists checks for the presence of a file on the server with a HEAD request.
+func (h *HttpFileSource) FileExists(relativeFilepath string) (bool, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return false, logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	fileUrl := h.GetFileUrl(relativeFilepath)
+	resp, cancel, err := h.do(http.MethodHead, fileUrl, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return false, logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// GetFileFingerprint returns the ETag of a file or, if the server does not send one, its
+// Last-Modified time and size.
+func (h *HttpFileSource) GetFileFingerprint(relativeFilepath string) (string, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return "", logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	fileUrl := h.GetFileUrl(relativeFilepath)
+	resp, cancel, err := h.do(http.MethodHead, fileUrl, nil, http.StatusOK)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		return lastModified + " " + resp.Header.Get("Content-Length"), nil
+	}
+
+	return "", nil
+}
+
+// hrefPattern matches the link targets in an HTML page.
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']+)["']`)
+
+// ListDirs crawls the index page that web servers (nginx autoindex, Apache mod_autoindex, ...) generate
+// for a directory, and returns the names of the directories it links to.
+func (h *HttpFileSource) ListDirs(relativeDirpath string) ([]string, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return nil, logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	dirUrl := strings.TrimSuffix(h.GetFileUrl(relativeDirpath), "/") + "/"
+	resp, cancel, err := h.do(http.MethodGet, dirUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not fetch directory index %s: %s", dirUrl, err.Error())
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not read directory index %s: %s", dirUrl, err.Error())
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, match := range hrefPattern.FindAllSubmatch(page, -1) {
+		target, err := url.PathUnescape(string(match[1]))
+		if err != nil {
+			continue
+		}
+		target = strings.TrimPrefix(target, "./")
+
+		// Only relative links to direct children that are directories
+		name := strings.TrimSuffix(target, "/")
+		if name == target || name == "" || name == "." || name == ".." ||
+			strings.ContainsAny(name, "/?#:") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		res = append(res, name)
+	}
+
+	return res, nil
+}
+
+// GetFileReaderAt returns a reader that fetches parts of the file with HTTP range requests.
+// domain.ErrRangesNotSupported is returned if the server does not advertise support for byte ranges.
+func (h *HttpFileSource) GetFileReaderAt(relativeFilepath string) (domain.ReadAtCloser, int64, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return nil, 0, logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	fileUrl := h.GetFileUrl(relativeFilepath)
+	resp, cancel, err := h.do(http.MethodHead, fileUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, 0, logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength < 0 {
+		return nil, 0, domain.ErrRangesNotSupported
+	}
+
+	return &httpReaderAt{do: h.do, fileUrl: fileUrl, size: resp.ContentLength}, resp.ContentLength, nil
+}
+
+// GetFilePublishedChecksum returns the checksum of a file as published by the server.
+// The X-Checksum-Sha256/X-Checksum-Md5 response headers (as set by Artifactory and the like) are
+// looked up first, then a checksum file published alongside, such as "<file>.sha256".
+func (h *HttpFileSource) GetFilePublishedChecksum(relativeFilepath string, checksumType string) (string, error) {
+	logger := GetAppLogger()
+
+	if h == nil || h.baseUrl == nil {
+		return "", logger.ErrorPrintf("called on a nil or uninitialized struct!")
+	}
+
+	fileUrl := h.GetFileUrl(relativeFilepath)
+	resp, cancel, err := h.do(http.MethodHead, fileUrl, nil, http.StatusOK)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	switch strings.ToLower(checksumType) {
+	case "sha256":
+		if checksum := resp.Header.Get("X-Checksum-Sha256"); checksum != "" {
+			return strings.ToLower(checksum), nil
+		}
+	case "md5":
+		if checksum := resp.Header.Get("X-Checksum-Md5"); checksum != "" {
+			return strings.ToLower(checksum), nil
+		}
+	}
+
+	return readPublishedChecksumFile(h, relativeFilepath, checksumType)
+}
+
+// do issues a request for fileUrl, retrying with an exponential backoff on network errors, 5xx and 429
+// responses. The response is returned only if its status is one of okStatuses, along with the function that
+// cancels the request; the caller is responsible for closing the body and calling it.
+func (h *HttpFileSource) do(method string, fileUrl string, header http.Header, okStatuses ...int) (*http.Response, context.CancelFunc, error) {
+	logger := GetAppLogger()
+
+	var lastErr error
+	for attempt := 0; attempt <= h.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(h.RetryBackoffSeconds) * time.Second * time.Duration(1<<uint(attempt-1))
+			logger.Printf("[INFO] Retrying %s %s in %s (attempt %d of %d): %s",
+				method, fileUrl, backoff, attempt, h.MaxRetries, lastErr.Error())
+			time.Sleep(backoff)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest(method, h.authorizeUrl(fileUrl), nil)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		h.auth.apply(req)
+		if h.prepareRequest != nil {
+			if err = h.prepareRequest(req); err != nil {
+				cancel()
+				return nil, nil, err
+			}
+		}
+
+		logger.Printf("[DEBUG] %s url: %s", method, fileUrl)
+		resp, err := h.Client.Do(req)
+		if err != nil {
+			cancel()
+			// Keep the token, if the url has one, out of errors and logs
+			if urlErr, ok := err.(*url.Error); ok {
+				urlErr.URL = fileUrl
+			}
+			lastErr = err
+			continue
+		}
+
+		for _, okStatus := range okStatuses {
+			if resp.StatusCode == okStatus {
+				return resp, cancel, nil
+			}
+		}
+
+		resp.Body.Close()
+		cancel()
+		lastErr = fmt.Errorf("unexpected http status: %s", resp.Status)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+
+	return nil, nil, lastErr
+}
+
+// authorizeUrl inserts the token into fileUrl, right after the base url, for token credentials
+// i.e. https://conda.anaconda.org/<channel>/... becomes https://conda.anaconda.org/t/<token>/<channel>/...
+// Urls that are not under the base url are returned as is.
+func (h *HttpFileSource) authorizeUrl(fileUrl string) string {
+	if h.auth.kind != domain.CredentialsToken {
+		return fileUrl
+	}
+
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return fileUrl
+	}
+
+	basePath := strings.TrimSuffix(h.baseUrl.Path, "/")
+	if u.Host != h.baseUrl.Host || !strings.HasPrefix(u.Path, basePath+"/") {
+		return fileUrl
+	}
+
+	u.Path = basePath + "/t/" + h.auth.token + u.Path[len(basePath):]
+	u.RawPath = ""
+	return u.String()
+}
+
+// httpReaderAt reads parts of a remote file using HTTP range requests. Since consumers like archive/zip
+// and decompressors tend to issue many small sequential reads, at least httpReadAheadBytes are fetched
+// per request and the last fetched block is kept around to serve the reads that follow.
+type httpReaderAt struct {
+	// do issues the range requests, as HttpFileSource.do does
+	do func(method string, fileUrl string, header http.Header, okStatuses ...int) (*http.Response, context.CancelFunc, error)
+
+	fileUrl string
+	size    int64
+
+	mu       sync.Mutex
+	blockOff int64
+	block    []byte
+}
+
+const httpReadAheadBytes = 1024 * 1024
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	if off < r.blockOff || end > r.blockOff+int64(len(r.block)) {
+		fetchEnd := end
+		if fetchEnd-off < httpReadAheadBytes {
+			fetchEnd = off + httpReadAheadBytes
+		}
+		if fetchEnd > r.size {
+			fetchEnd = r.size
+		}
+
+		block, err := r.fetchRange(off, fetchEnd)
+		if err != nil {
+			return 0, err
+		}
+		r.blockOff, r.block = off, block
+	}
+
+	n := copy(p, r.block[off-r.blockOff:end-r.blockOff])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetchRange fetches the bytes [start, end) of the file.
+func (r *httpReaderAt) fetchRange(start, end int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	resp, cancel, err := r.do(http.MethodGet, r.fileUrl, header, http.StatusPartialContent)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch range %d-%d of %s: %s", start, end-1, r.fileUrl, err.Error())
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	block := make([]byte, end-start)
+	if _, err = io.ReadFull(resp.Body, block); err != nil {
+		return nil, fmt.Errorf("could not read range %d-%d of %s: %s", start, end-1, r.fileUrl, err.Error())
+	}
+	return block, nil
+}
+
+func (r *httpReaderAt) Close() error {
+	r.mu.Lock()
+	r.block = nil
+	r.mu.Unlock()
+	return nil
+}
+
+// idleTimeoutReadCloser cancels the request backing a response body if no data could be read
+// from it for a given duration. It allows arbitrarily long downloads while still failing fast
+// on connections that have stopped making progress.
+type idleTimeoutReadCloser struct {
+	rc      io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutReadCloser(rc io.ReadCloser, cancel context.CancelFunc, timeout time.Duration) io.ReadCloser {
+	return &idleTimeoutReadCloser{
+		rc:      rc,
+		cancel:  cancel,
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, cancel),
+	}
+}
+
+func (t *idleTimeoutReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		t.timer.Reset(t.timeout)
+	}
+	return n, err
+}
+
+func (t *idleTimeoutReadCloser) Close() error {
+	t.timer.Stop()
+	err := t.rc.Close()
+	t.cancel()
+	return err
+}
@@ -0,0 +1,283 @@
+package helpers
+
+import (
+	"bytes"
+	"conda-rlookup/domain"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeChannel serves the files of a conda channel from memory, under /channel/.
+type fakeChannel struct {
+	files map[string][]byte
+
+	// failures is the number of requests that are answered with a 503 before any is served
+	failures int32
+	requests int32
+}
+
+func (c *fakeChannel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&c.requests, 1)
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, ok := c.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
+
+func newTestHttpFileSource(t *testing.T, handler http.Handler) *HttpFileSource {
+	svr := httptest.NewServer(handler)
+	t.Cleanup(svr.Close)
+
+	src := &HttpFileSource{
+		BaseUrl:             svr.URL + "/channel",
+		TimeoutSeconds:      1,
+		MaxRetries:          2,
+		RetryBackoffSeconds: 1,
+	}
+	if err := src.Init(); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	return src
+}
+
+func TestHttpFileSourceRetriesServerErrors(t *testing.T) {
+	ch := &fakeChannel{
+		files:    map[string][]byte{"/channel/noarch/repodata.json": []byte(`{"packages": {}}`)},
+		failures: 1,
+	}
+	src := newTestHttpFileSource(t, ch)
+
+	start := time.Now()
+	rc, err := src.GetFileReadCloser("noarch/repodata.json")
+	if err != nil {
+		t.Fatalf("GetFileReadCloser: %s", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	if string(data) != `{"packages": {}}` {
+		t.Errorf("got %q", data)
+	}
+	if n := atomic.LoadInt32(&ch.requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want a backoff of at least 1s", elapsed)
+	}
+}
+
+func TestHttpFileSourceGivesUpAfterMaxRetries(t *testing.T) {
+	ch := &fakeChannel{failures: 100}
+	src := newTestHttpFileSource(t, ch)
+	src.MaxRetries = 1
+
+	if _, err := src.GetFileReadCloser("noarch/repodata.json"); err == nil {
+		t.Fatal("got no error")
+	}
+	if n := atomic.LoadInt32(&ch.requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestHttpFileSourceDoesNotRetryClientErrors(t *testing.T) {
+	ch := &fakeChannel{}
+	src := newTestHttpFileSource(t, ch)
+
+	if _, err := src.GetFileReadCloser("noarch/missing.json"); err == nil {
+		t.Fatal("got no error")
+	}
+	if n := atomic.LoadInt32(&ch.requests); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestHttpFileSourceFileExists(t *testing.T) {
+	ch := &fakeChannel{files: map[string][]byte{"/channel/noarch/repodata.json": []byte(`{}`)}}
+	src := newTestHttpFileSource(t, ch)
+
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"noarch/repodata.json", true},
+		{"noarch/repodata.json.zst", false},
+	} {
+		got, err := src.FileExists(tc.name)
+		if err != nil {
+			t.Errorf("FileExists(%s): %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("FileExists(%s) = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHttpFileSourceStreamsPackageChecksum(t *testing.T) {
+	pkg, err := ioutil.ReadFile(filepath.Join("testdata", "fake-1.0-0.tar.bz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(pkg)
+	ch := &fakeChannel{files: map[string][]byte{"/channel/noarch/fake-1.0-0.tar.bz2": pkg}}
+	src := newTestHttpFileSource(t, ch)
+
+	rc, err := src.GetFileReadCloser("noarch/fake-1.0-0.tar.bz2")
+	if err != nil {
+		t.Fatalf("GetFileReadCloser: %s", err)
+	}
+	defer rc.Close()
+
+	destDir := t.TempDir()
+	checksum, err := TarBz2ExtractFilesAndGetChecksum(rc, destDir, []string{"info/index.json"}, nil, "sha256")
+	if err != nil {
+		t.Fatalf("TarBz2ExtractFilesAndGetChecksum: %s", err)
+	}
+
+	if want := hex.EncodeToString(sum[:]); checksum != want {
+		t.Errorf("got checksum %s, want %s", checksum, want)
+	}
+	if _, err = os.Stat(filepath.Join(destDir, "info", "index.json")); err != nil {
+		t.Errorf("info/index.json was not extracted: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(destDir, "bin", "fake")); !os.IsNotExist(err) {
+		t.Errorf("bin/fake was extracted")
+	}
+}
+
+func TestHttpFileSourceIdleTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	defer close(stalled)
+	src := newTestHttpFileSource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+	}))
+
+	rc, err := src.GetFileReadCloser("noarch/repodata.json")
+	if err != nil {
+		t.Fatalf("GetFileReadCloser: %s", err)
+	}
+	defer rc.Close()
+
+	start := time.Now()
+	data, err := ioutil.ReadAll(rc)
+	if err == nil {
+		t.Fatal("got no error reading a stalled response")
+	}
+	if string(data) != "partial" {
+		t.Errorf("got %q before the timeout", data)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out after %s, want about 1s", elapsed)
+	}
+}
+
+// rangeChannel serves the files of a conda channel from memory, under /channel/, honouring Range requests.
+type rangeChannel struct {
+	files map[string][]byte
+
+	requests      int32
+	rangeRequests int32
+}
+
+func (c *rangeChannel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&c.requests, 1)
+	if r.Header.Get("Range") != "" {
+		atomic.AddInt32(&c.rangeRequests, 1)
+	}
+	data, ok := c.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+}
+
+func TestHttpFileSourceReadsByteRanges(t *testing.T) {
+	data := make([]byte, 3*httpReadAheadBytes+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	ch := &rangeChannel{files: map[string][]byte{"/channel/noarch/foo-1.0-0.conda": data}}
+	src := newTestHttpFileSource(t, ch)
+
+	ra, size, err := src.GetFileReaderAt("noarch/foo-1.0-0.conda")
+	if err != nil {
+		t.Fatalf("GetFileReaderAt: %s", err)
+	}
+	defer ra.Close()
+	if size != int64(len(data)) {
+		t.Fatalf("got size %d, want %d", size, len(data))
+	}
+
+	for _, tc := range []struct {
+		desc          string
+		off           int64
+		n             int
+		err           error
+		rangeRequests int32 // in total, so far
+	}{
+		{"start", 0, 10, nil, 1},
+		{"read ahead", 10, 1000, nil, 1},
+		{"beyond the read-ahead", httpReadAheadBytes + 5, 10, nil, 2},
+		{"backwards", 5, 10, nil, 3},
+		{"larger than the read-ahead", 100, 2 * httpReadAheadBytes, nil, 4},
+		{"across the end", int64(len(data)) - 10, 20, io.EOF, 5},
+		{"past the end", int64(len(data)), 1, io.EOF, 5},
+	} {
+		p := make([]byte, tc.n)
+		n, err := ra.ReadAt(p, tc.off)
+		if err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.desc, err, tc.err)
+		}
+		want := data[tc.off:]
+		if len(want) > tc.n {
+			want = want[:tc.n]
+		}
+		if !bytes.Equal(p[:n], want) {
+			t.Errorf("%s: got %d bytes that are not those at %d", tc.desc, n, tc.off)
+		}
+		if got := atomic.LoadInt32(&ch.rangeRequests); got != tc.rangeRequests {
+			t.Errorf("%s: got %d range requests so far, want %d", tc.desc, got, tc.rangeRequests)
+		}
+	}
+}
+
+func TestHttpFileSourceTellsOfServersRefusingByteRanges(t *testing.T) {
+	ch := &fakeChannel{files: map[string][]byte{"/channel/noarch/foo-1.0-0.conda": []byte("PK")}}
+	src := newTestHttpFileSource(t, ch)
+
+	if _, _, err := src.GetFileReaderAt("noarch/foo-1.0-0.conda"); err != domain.ErrRangesNotSupported {
+		t.Errorf("got error %v, want %v", err, domain.ErrRangesNotSupported)
+	}
+	if _, _, err := src.GetFileReaderAt("noarch/missing-1.0-0.conda"); err == nil || err == domain.ErrRangesNotSupported {
+		t.Errorf("got error %v for a missing file", err)
+	}
+}
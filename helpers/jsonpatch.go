@@ -0,0 +1,242 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JsonPatchOperation is a single operation of a JSON patch (RFC 6902).
+type JsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// ApplyJsonPatch applies the operations of a JSON patch (RFC 6902) in order to doc, which is a document
+// decoded by encoding/json into an interface{}, and returns the patched document. doc is modified in place
+// as far as possible, so it must not be used after an error.
+func ApplyJsonPatch(doc interface{}, patch []JsonPatchOperation) (interface{}, error) {
+	var err error
+	for i, op := range patch {
+		if doc, err = applyJsonPatchOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, op.Op, op.Path, err.Error())
+		}
+	}
+	return doc, nil
+}
+
+func applyJsonPatchOperation(doc interface{}, op JsonPatchOperation) (interface{}, error) {
+	tokens, err := parseJsonPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return jsonPointerAdd(doc, tokens, op.Value)
+	case "remove":
+		doc, _, err = jsonPointerRemove(doc, tokens)
+		return doc, err
+	case "replace":
+		if doc, _, err = jsonPointerRemove(doc, tokens); err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, tokens, op.Value)
+	case "move", "copy":
+		fromTokens, err := parseJsonPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var val interface{}
+		if op.Op == "move" {
+			doc, val, err = jsonPointerRemove(doc, fromTokens)
+		} else {
+			val, err = jsonPointerGet(doc, fromTokens)
+			val = deepCopyJson(val)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, tokens, val)
+	case "test":
+		val, err := jsonPointerGet(doc, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(val, op.Value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unsupported operation")
+	}
+}
+
+// parseJsonPointer splits a JSON pointer (RFC 6901) into its unescaped reference tokens.
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// jsonPointerGet returns the value at tokens in doc.
+func jsonPointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			val, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			doc = val
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerAdd adds val at tokens in doc and returns the resulting document.
+func jsonPointerAdd(doc interface{}, tokens []string, val interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return val, nil
+	}
+
+	return jsonPointerUpdateParent(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = val
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, val), nil
+			}
+			i, err := jsonArrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = val
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", token)
+		}
+	})
+}
+
+// jsonPointerRemove removes the value at tokens in doc and returns the resulting document and the removed value.
+func jsonPointerRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	doc, err := jsonPointerUpdateParent(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			val, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			removed = val
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove %q from a scalar", token)
+		}
+	})
+	return doc, removed, err
+}
+
+// jsonPointerUpdateParent replaces the parent of the value at tokens in doc with what fn returns for it and
+// the last token, and returns the resulting document. Arrays can grow or shrink this way.
+func jsonPointerUpdateParent(doc interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("member %q does not exist", tokens[0])
+		}
+		newChild, err := jsonPointerUpdateParent(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = newChild
+		return node, nil
+	case []interface{}:
+		i, err := jsonArrayIndex(tokens[0], len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := jsonPointerUpdateParent(node[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = newChild
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot reference %q in a scalar", tokens[0])
+	}
+}
+
+// jsonArrayIndex parses token as an array index that must be at most max.
+func jsonArrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// deepCopyJson returns a copy of a document decoded by encoding/json that shares nothing with it.
+func deepCopyJson(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			res[k] = deepCopyJson(elem)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, elem := range v {
+			res[i] = deepCopyJson(elem)
+		}
+		return res
+	default:
+		return v
+	}
+}
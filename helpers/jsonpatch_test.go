@@ -0,0 +1,93 @@
+package helpers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyJsonPatch(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		doc   string
+		patch string
+		want  string // empty if the patch must fail
+	}{
+		{"add member", `{"a": 1}`, `[{"op": "add", "path": "/b", "value": 2}]`, `{"a": 1, "b": 2}`},
+		{"add replaces member", `{"a": 1}`, `[{"op": "add", "path": "/a", "value": [3]}]`, `{"a": [3]}`},
+		{"add to nested", `{"a": {"b": {}}}`, `[{"op": "add", "path": "/a/b/c", "value": null}]`, `{"a": {"b": {"c": null}}}`},
+		{"add inserts into array", `{"a": [1, 3]}`, `[{"op": "add", "path": "/a/1", "value": 2}]`, `{"a": [1, 2, 3]}`},
+		{"add at end of array", `{"a": [1, 2]}`, `[{"op": "add", "path": "/a/2", "value": 3}]`, `{"a": [1, 2, 3]}`},
+		{"add appends with -", `{"a": [1, 2]}`, `[{"op": "add", "path": "/a/-", "value": 3}]`, `{"a": [1, 2, 3]}`},
+		{"add past end of array", `{"a": [1]}`, `[{"op": "add", "path": "/a/2", "value": 3}]`, ""},
+		{"add with missing parent", `{}`, `[{"op": "add", "path": "/a/b", "value": 1}]`, ""},
+		{"add whole document", `{"a": 1}`, `[{"op": "add", "path": "", "value": [1]}]`, `[1]`},
+		{"add with ~1 escape", `{}`, `[{"op": "add", "path": "/linux-64~1foo.tar.bz2", "value": 1}]`, `{"linux-64/foo.tar.bz2": 1}`},
+		{"add with ~0 escape", `{}`, `[{"op": "add", "path": "/a~0b", "value": 1}]`, `{"a~b": 1}`},
+		{"~01 unescapes to ~1", `{}`, `[{"op": "add", "path": "/~01", "value": 1}]`, `{"~1": 1}`},
+
+		{"remove member", `{"a": 1, "b": 2}`, `[{"op": "remove", "path": "/a"}]`, `{"b": 2}`},
+		{"remove from array", `{"a": [1, 2, 3]}`, `[{"op": "remove", "path": "/a/1"}]`, `{"a": [1, 3]}`},
+		{"remove with escapes", `{"a/b": 1, "c~d": 2}`, `[{"op": "remove", "path": "/a~1b"}, {"op": "remove", "path": "/c~0d"}]`, `{}`},
+		{"remove missing member", `{"a": 1}`, `[{"op": "remove", "path": "/b"}]`, ""},
+		{"remove with -", `{"a": [1]}`, `[{"op": "remove", "path": "/a/-"}]`, ""},
+		{"remove past end of array", `{"a": [1]}`, `[{"op": "remove", "path": "/a/1"}]`, ""},
+		{"remove whole document", `{"a": 1}`, `[{"op": "remove", "path": ""}]`, ""},
+
+		{"replace member", `{"a": 1}`, `[{"op": "replace", "path": "/a", "value": "x"}]`, `{"a": "x"}`},
+		{"replace in array", `{"a": [1, 2]}`, `[{"op": "replace", "path": "/a/0", "value": 0}]`, `{"a": [0, 2]}`},
+		{"replace missing member", `{"a": 1}`, `[{"op": "replace", "path": "/b", "value": 2}]`, ""},
+
+		{"move member", `{"a": {"x": 1}, "b": {}}`, `[{"op": "move", "from": "/a/x", "path": "/b/y"}]`, `{"a": {}, "b": {"y": 1}}`},
+		{"move within array", `{"a": [1, 2, 3]}`, `[{"op": "move", "from": "/a/0", "path": "/a/-"}]`, `{"a": [2, 3, 1]}`},
+		{"move with escapes", `{"a/b": 1}`, `[{"op": "move", "from": "/a~1b", "path": "/a~0b"}]`, `{"a~b": 1}`},
+		{"move missing member", `{"a": 1}`, `[{"op": "move", "from": "/b", "path": "/c"}]`, ""},
+
+		{"copy member", `{"a": {"x": [1]}}`, `[{"op": "copy", "from": "/a/x", "path": "/b"}]`, `{"a": {"x": [1]}, "b": [1]}`},
+		{"copy is deep", `{"a": {"x": 1}}`, `[{"op": "copy", "from": "/a", "path": "/b"}, {"op": "replace", "path": "/b/x", "value": 2}]`, `{"a": {"x": 1}, "b": {"x": 2}}`},
+		{"copy into array", `{"a": [1, 2]}`, `[{"op": "copy", "from": "/a/1", "path": "/a/0"}]`, `{"a": [2, 1, 2]}`},
+		{"copy missing member", `{"a": 1}`, `[{"op": "copy", "from": "/b", "path": "/c"}]`, ""},
+
+		{"test passes", `{"a": {"b": [1, "x"]}}`, `[{"op": "test", "path": "/a", "value": {"b": [1, "x"]}}]`, `{"a": {"b": [1, "x"]}}`},
+		{"test with escapes", `{"a/b": {"c~d": 1}}`, `[{"op": "test", "path": "/a~1b/c~0d", "value": 1}]`, `{"a/b": {"c~d": 1}}`},
+		{"test fails", `{"a": 1}`, `[{"op": "test", "path": "/a", "value": 2}]`, ""},
+		{"test of missing member", `{"a": 1}`, `[{"op": "test", "path": "/b", "value": 1}]`, ""},
+		{"test failing stops patch", `{"a": 1}`, `[{"op": "test", "path": "/a", "value": "1"}, {"op": "remove", "path": "/a"}]`, ""},
+
+		{"operations apply in order", `{}`, `[{"op": "add", "path": "/a", "value": []}, {"op": "add", "path": "/a/-", "value": 1}, {"op": "add", "path": "/a/0", "value": 0}]`, `{"a": [0, 1]}`},
+		{"unsupported operation", `{}`, `[{"op": "merge", "path": "/a", "value": 1}]`, ""},
+		{"invalid pointer", `{}`, `[{"op": "add", "path": "a", "value": 1}]`, ""},
+		{"leading zero index", `{"a": [1, 2]}`, `[{"op": "remove", "path": "/a/01"}]`, ""},
+		{"member of scalar", `{"a": 1}`, `[{"op": "add", "path": "/a/b", "value": 1}]`, ""},
+	} {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(tc.doc), &doc); err != nil {
+			t.Fatalf("%s: bad doc: %s", tc.desc, err)
+		}
+		var patch []JsonPatchOperation
+		if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+			t.Fatalf("%s: bad patch: %s", tc.desc, err)
+		}
+
+		got, err := ApplyJsonPatch(doc, patch)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got no error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+
+		var want interface{}
+		if err = json.Unmarshal([]byte(tc.want), &want); err != nil {
+			t.Fatalf("%s: bad want: %s", tc.desc, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			data, _ := json.Marshal(got)
+			t.Errorf("%s: got %s, want %s", tc.desc, data, tc.want)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package helpers
 
 import (
+	"conda-rlookup/domain"
 	"conda-rlookup/utils"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -54,11 +56,11 @@ func (l *LocalFileSource) GetFileReadCloser(relativeFilepath string) (io.ReadClo
 	baseFilename := filepath.Base(relativeFilepath)
 	parentDir := filepath.Dir(relativeFilepath)
 
-	if baseFilename == "repodata.json" {
+	if IsRepodataFile(baseFilename) {
 		// Create a temporary file for writing repodata to
-		tmpFile, err := ioutil.TempFile(l.TempDir, ".tmp.repodata.json.*")
+		tmpFile, err := ioutil.TempFile(l.TempDir, ".tmp."+baseFilename+".*")
 		if err != nil {
-			return nil, logger.ErrorPrintf("could not create tempfile for copying repodata.json: %s", err.Error())
+			return nil, logger.ErrorPrintf("could not create tempfile for copying %s: %s", baseFilename, err.Error())
 		}
 
 		// cleanup the temporary file on errors
@@ -98,8 +100,9 @@ func (l *LocalFileSource) GetFileReadCloser(relativeFilepath string) (io.ReadClo
 		if err != nil {
 			return nil, logger.ErrorPrintf("could not open file %s for reading: %s", repodataFilename, err.Error())
 		}
+		defer repodataFile.Close()
 		if _, err = io.Copy(tmpFile, repodataFile); err != nil {
-			return nil, logger.ErrorPrintf("could not copy repodata.json to tempfile %s: %s", tmpFile.Name(), err.Error())
+			return nil, logger.ErrorPrintf("could not copy %s to tempfile %s: %s", baseFilename, tmpFile.Name(), err.Error())
 		}
 		if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
 			return nil, logger.ErrorPrintf("could not rewind file %s: %s", tmpFile.Name(), err.Error())
@@ -117,3 +120,102 @@ func (l *LocalFileSource) GetFileReadCloser(relativeFilepath string) (io.ReadClo
 
 	return f, nil
 }
+
+// FileExists checks for the presence of a file under SourceDir.
+func (l *LocalFileSource) FileExists(relativeFilepath string) (bool, error) {
+	logger := GetAppLogger()
+
+	if l == nil {
+		return false, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	targetFilename := filepath.Join(l.SourceDir, relativeFilepath)
+	if _, err := os.Stat(targetFilename); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, logger.ErrorPrintf("could not stat file %s: %s", targetFilename, err.Error())
+	}
+
+	return true, nil
+}
+
+// GetFileFingerprint returns the size and modification time of a file.
+func (l *LocalFileSource) GetFileFingerprint(relativeFilepath string) (string, error) {
+	logger := GetAppLogger()
+
+	if l == nil {
+		return "", logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	fi, err := os.Stat(filepath.Join(l.SourceDir, relativeFilepath))
+	if err != nil {
+		return "", logger.ErrorPrintf("could not stat file %s: %s", relativeFilepath, err.Error())
+	}
+
+	return fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// GetFileReaderAt opens the file for random access. Local files always support it.
+func (l *LocalFileSource) GetFileReaderAt(relativeFilepath string) (domain.ReadAtCloser, int64, error) {
+	logger := GetAppLogger()
+
+	if l == nil {
+		return nil, 0, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	targetFilename := filepath.Join(l.SourceDir, relativeFilepath)
+	f, err := os.OpenFile(targetFilename, os.O_RDONLY, 0755)
+	if err != nil {
+		return nil, 0, logger.ErrorPrintf("could not open file %s for reading: %s", targetFilename, err.Error())
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, logger.ErrorPrintf("could not stat file %s: %s", targetFilename, err.Error())
+	}
+
+	return f, fi.Size(), nil
+}
+
+// GetFilePublishedChecksum reads the checksum of a file from the checksum file next to it,
+// such as "<file>.sha256".
+func (l *LocalFileSource) GetFilePublishedChecksum(relativeFilepath string, checksumType string) (string, error) {
+	logger := GetAppLogger()
+
+	if l == nil {
+		return "", logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	return readPublishedChecksumFile(l, relativeFilepath, checksumType)
+}
+
+// ListDirs returns the names of the directories (or symlinks to directories) under a directory in SourceDir.
+func (l *LocalFileSource) ListDirs(relativeDirpath string) ([]string, error) {
+	logger := GetAppLogger()
+
+	if l == nil {
+		return nil, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	targetDirname := filepath.Join(l.SourceDir, relativeDirpath)
+	entries, err := ioutil.ReadDir(targetDirname)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not list directory %s: %s", targetDirname, err.Error())
+	}
+
+	var res []string
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if fi, err := os.Stat(filepath.Join(targetDirname, entry.Name())); err == nil {
+				entry = fi
+			}
+		}
+		if entry.IsDir() {
+			res = append(res, entry.Name())
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,13 @@
+package helpers
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := InitAppLogger(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,452 @@
+package helpers
+
+import (
+	"conda-rlookup/domain"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media types of the layers that conda artifacts are stored as in OCI registries
+const (
+	OciMediaTypeRepodata      = "application/vnd.conda.repodata.v1+json"
+	OciMediaTypeCondaPackage  = "application/vnd.conda.package.v1"
+	OciMediaTypeCondaPackage2 = "application/vnd.conda.package.v2"
+
+	ociManifestMediaTypes = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// OciFileSource serves conda channel files from an OCI registry with the layout used by conda-oci-mirror
+// (e.g. the ghcr.io/channel-mirrors/conda-forge mirror), through the standard OCI distribution API:
+//   - "<channel>/<subdir>/repodata.json" is the single layer of repository
+//     <Namespace>/<channel>/<subdir>/repodata.json tagged "latest".
+//   - "<channel>/<subdir>/<name>-<version>-<build>.<ext>" is a layer of repository
+//     <Namespace>/<channel>/<subdir>/<name> tagged "<version>-<build>".
+//
+// Bearer tokens are obtained from the registry as challenged, and cached per repository. They are anonymous
+// unless basic Credentials are set; bearer or token Credentials are sent to the registry as is instead.
+type OciFileSource struct {
+	Registry    string
+	Namespace   string
+	Credentials domain.Credentials
+
+	TimeoutSeconds      int
+	MaxRetries          int
+	RetryBackoffSeconds int
+
+	http HttpFileSource
+	auth httpAuth
+
+	mu       sync.Mutex
+	tokens   map[string]string
+	useBasic bool
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+func (o *OciFileSource) Init() error {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	if o.Registry == "" {
+		return logger.ErrorPrintf("registry is required for an OCI file source")
+	}
+
+	registryUrl := strings.TrimSuffix(o.Registry, "/")
+	if !strings.Contains(registryUrl, "://") {
+		registryUrl = "https://" + registryUrl
+	}
+
+	u, err := url.Parse(registryUrl)
+	if err != nil {
+		return logger.ErrorPrintf("could not parse registry url %s: %s", registryUrl, err.Error())
+	}
+	if o.auth, err = resolveCredentials(o.Credentials, u.Hostname()); err != nil {
+		return logger.ErrorPrintf("could not resolve credentials for registry %s: %s", o.Registry, err.Error())
+	}
+
+	o.tokens = make(map[string]string)
+	o.http = HttpFileSource{
+		BaseUrl:             registryUrl + "/v2",
+		TimeoutSeconds:      o.TimeoutSeconds,
+		MaxRetries:          o.MaxRetries,
+		RetryBackoffSeconds: o.RetryBackoffSeconds,
+		prepareRequest:      o.authorizeRequest,
+	}
+
+	return o.http.Init()
+}
+
+func (o *OciFileSource) GetFileReadCloser(relativeFilepath string) (io.ReadCloser, error) {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return nil, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	repo, layer, err := o.resolveLayer(relativeFilepath)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not resolve %s in registry: %s", relativeFilepath, err.Error())
+	}
+	if layer == nil {
+		return nil, logger.ErrorPrintf("could not find %s in registry", relativeFilepath)
+	}
+
+	blobUrl := o.http.GetFileUrl(path.Join(repo, "blobs", layer.Digest))
+	resp, cancel, err := o.do(http.MethodGet, repo, blobUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not fetch blob %s for %s: %s", layer.Digest, relativeFilepath, err.Error())
+	}
+
+	return newIdleTimeoutReadCloser(resp.Body, cancel, time.Duration(o.http.TimeoutSeconds)*time.Second), nil
+}
+
+func (o *OciFileSource) FileExists(relativeFilepath string) (bool, error) {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return false, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	if _, _, _, ok := ociReference(o.Namespace, relativeFilepath); !ok {
+		return false, nil
+	}
+
+	_, layer, err := o.resolveLayer(relativeFilepath)
+	if err != nil {
+		return false, logger.ErrorPrintf("could not resolve %s in registry: %s", relativeFilepath, err.Error())
+	}
+
+	return layer != nil, nil
+}
+
+// GetFileReaderAt reads parts of the blob of a file with range requests, which registries generally support.
+func (o *OciFileSource) GetFileReaderAt(relativeFilepath string) (domain.ReadAtCloser, int64, error) {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return nil, 0, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	repo, layer, err := o.resolveLayer(relativeFilepath)
+	if err != nil {
+		return nil, 0, logger.ErrorPrintf("could not resolve %s in registry: %s", relativeFilepath, err.Error())
+	}
+	if layer == nil {
+		return nil, 0, logger.ErrorPrintf("could not find %s in registry", relativeFilepath)
+	}
+
+	// Make sure there is a token for the repository before handing the blob over to the range reader
+	blobUrl := o.http.GetFileUrl(path.Join(repo, "blobs", layer.Digest))
+	resp, cancel, err := o.do(http.MethodHead, repo, blobUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, 0, logger.ErrorPrintf("could not fetch headers for blob %s: %s", layer.Digest, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil, 0, domain.ErrRangesNotSupported
+	}
+
+	// Range requests go through o.do as well, for the token to be renewed should it expire mid-way
+	do := func(method string, fileUrl string, header http.Header, okStatuses ...int) (*http.Response, context.CancelFunc, error) {
+		return o.do(method, repo, fileUrl, header, okStatuses...)
+	}
+	return &httpReaderAt{do: do, fileUrl: blobUrl, size: layer.Size}, layer.Size, nil
+}
+
+// GetFileFingerprint returns the digest of the blob of a file.
+func (o *OciFileSource) GetFileFingerprint(relativeFilepath string) (string, error) {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return "", logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	_, layer, err := o.resolveLayer(relativeFilepath)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not resolve %s in registry: %s", relativeFilepath, err.Error())
+	}
+	if layer == nil {
+		return "", logger.ErrorPrintf("could not find %s in registry", relativeFilepath)
+	}
+
+	return layer.Digest, nil
+}
+
+// GetFilePublishedChecksum returns the digest of the blob of a file, which is its sha256 checksum.
+func (o *OciFileSource) GetFilePublishedChecksum(relativeFilepath string, checksumType string) (string, error) {
+	logger := GetAppLogger()
+
+	if o == nil {
+		return "", logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	if strings.ToLower(checksumType) != "sha256" {
+		return "", logger.ErrorPrintf("registries only publish sha256 checksums, not %s", checksumType)
+	}
+
+	_, layer, err := o.resolveLayer(relativeFilepath)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not resolve %s in registry: %s", relativeFilepath, err.Error())
+	}
+	if layer == nil {
+		return "", logger.ErrorPrintf("could not find %s in registry", relativeFilepath)
+	}
+
+	return strings.TrimPrefix(layer.Digest, "sha256:"), nil
+}
+
+// resolveLayer fetches the manifest a file is stored in, and returns the repository along with the
+// layer for the file. A nil layer is returned, without an error, if the manifest or layer do not exist.
+func (o *OciFileSource) resolveLayer(relativeFilepath string) (string, *ociDescriptor, error) {
+	repo, tag, mediaType, ok := ociReference(o.Namespace, relativeFilepath)
+	if !ok {
+		return "", nil, fmt.Errorf("%s cannot be stored in an OCI registry", relativeFilepath)
+	}
+
+	manifestUrl := o.http.GetFileUrl(path.Join(repo, "manifests", tag))
+	header := http.Header{}
+	header.Set("Accept", ociManifestMediaTypes)
+	resp, cancel, err := o.do(http.MethodGet, repo, manifestUrl, header, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not fetch manifest %s:%s: %s", repo, tag, err.Error())
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return repo, nil, nil
+	}
+
+	var manifest ociManifest
+	if err = json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return "", nil, fmt.Errorf("could not parse manifest %s:%s: %s", repo, tag, err.Error())
+	}
+
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == mediaType {
+			return repo, &manifest.Layers[i], nil
+		}
+	}
+
+	return repo, nil, nil
+}
+
+// do issues a request for repository repo, obtaining a bearer token and trying again if the
+// registry challenges the request.
+func (o *OciFileSource) do(method string, repo string, fileUrl string, header http.Header, okStatuses ...int) (*http.Response, context.CancelFunc, error) {
+	resp, cancel, err := o.http.do(method, fileUrl, header, append(okStatuses, http.StatusUnauthorized)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, cancel, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	cancel()
+
+	if o.auth.token != "" {
+		return nil, nil, fmt.Errorf("registry rejected the configured token")
+	}
+
+	if err = o.fetchToken(repo, challenge); err != nil {
+		return nil, nil, fmt.Errorf("could not authorize with registry: %s", err.Error())
+	}
+
+	return o.http.do(method, fileUrl, header, okStatuses...)
+}
+
+// fetchToken obtains a bearer token for pulling from repository repo following a
+// `Bearer realm="...",service="...",scope="..."` challenge, authenticating with basic credentials if set.
+// A `Basic` challenge is answered by sending the basic credentials with every request instead.
+func (o *OciFileSource) fetchToken(repo string, challenge string) error {
+	logger := GetAppLogger()
+
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") && o.auth.kind == domain.CredentialsBasic {
+		o.mu.Lock()
+		o.useBasic = true
+		o.mu.Unlock()
+		return nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+
+	params := parseAuthChallengeParams(challenge[len("bearer "):])
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("no realm in authentication challenge: %q", challenge)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + repo + ":pull"
+	}
+	query.Set("scope", scope)
+
+	tokenUrl := realm + "?" + query.Encode()
+	logger.Printf("[DEBUG] Fetching registry token for repository: %s", repo)
+	req, err := http.NewRequest(http.MethodGet, tokenUrl, nil)
+	if err != nil {
+		return err
+	}
+	o.auth.apply(req)
+	resp, err := o.http.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status from token server: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("could not parse token server response: %s", err.Error())
+	}
+
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+
+	o.mu.Lock()
+	o.tokens[repo] = token
+	o.mu.Unlock()
+
+	return nil
+}
+
+// authorizeRequest sets the bearer token of the repository a registry API request is for, if there is one.
+// Configured bearer or token credentials, and basic ones once challenged for, are set on every request.
+func (o *OciFileSource) authorizeRequest(req *http.Request) error {
+	if o.auth.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.auth.token)
+		return nil
+	}
+
+	o.mu.Lock()
+	useBasic := o.useBasic
+	o.mu.Unlock()
+	if useBasic {
+		o.auth.apply(req)
+		return nil
+	}
+
+	// API paths look like /v2/<repo>/manifests/<tag> or /v2/<repo>/blobs/<digest>
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(p, sep); i >= 0 {
+			o.mu.Lock()
+			token := o.tokens[p[:i]]
+			o.mu.Unlock()
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// ociReference maps the relative location of a conda file to the repository, tag and layer media type
+// it is stored as in the registry. ok is false if the file is not one that can be stored in a registry.
+func ociReference(namespace string, relativeFilepath string) (repo string, tag string, mediaType string, ok bool) {
+	dir := filepath.ToSlash(filepath.Dir(relativeFilepath))
+	base := filepath.Base(relativeFilepath)
+
+	if base == "repodata.json" {
+		return path.Join(namespace, dir, base), "latest", OciMediaTypeRepodata, true
+	}
+
+	var stem string
+	switch {
+	case strings.HasSuffix(base, ".tar.bz2"):
+		stem, mediaType = strings.TrimSuffix(base, ".tar.bz2"), OciMediaTypeCondaPackage
+	case strings.HasSuffix(base, ".conda"):
+		stem, mediaType = strings.TrimSuffix(base, ".conda"), OciMediaTypeCondaPackage2
+	default:
+		return "", "", "", false
+	}
+
+	// <name>-<version>-<build>; names may contain dashes, versions and builds may not
+	buildSep := strings.LastIndex(stem, "-")
+	if buildSep <= 0 {
+		return "", "", "", false
+	}
+	versionSep := strings.LastIndex(stem[:buildSep], "-")
+	if versionSep <= 0 {
+		return "", "", "", false
+	}
+	name, versionBuild := stem[:versionSep], stem[versionSep+1:]
+
+	// Repository names must start with an alphanumeric, tags can't contain some of the version characters
+	if strings.HasPrefix(name, "_") {
+		name = "zzz" + name
+	}
+	tag = strings.NewReplacer("+", "__p__", "!", "__e__", "=", "__eq__").Replace(versionBuild)
+
+	return path.Join(namespace, dir, name), tag, mediaType, true
+}
+
+// parseAuthChallengeParams parses the comma separated key="value" pairs of a WWW-Authenticate challenge.
+func parseAuthChallengeParams(s string) map[string]string {
+	res := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			val, s = s[:comma], s[comma:]
+		} else {
+			val, s = s, ""
+		}
+		res[key] = val
+	}
+	return res
+}
@@ -0,0 +1,219 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is a local stand-in for an OCI registry: it serves the manifests and blobs of its repositories
+// through the distribution API, to bearer tokens handed out by its token endpoint only.
+type fakeRegistry struct {
+	t   *testing.T
+	url string
+
+	mu        sync.Mutex
+	manifests map[string]ociManifest // by "<repo>:<tag>"
+	blobs     map[string][]byte      // by digest
+	tokens    map[string]string      // valid tokens, to the scope they were issued for
+	nTokens   int
+	scopes    []string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:         t,
+		manifests: make(map[string]ociManifest),
+		blobs:     make(map[string][]byte),
+		tokens:    make(map[string]string),
+	}
+	svr := httptest.NewServer(r)
+	t.Cleanup(svr.Close)
+	r.url = svr.URL
+	return r
+}
+
+// push stores data as the single layer of repo:tag.
+func (r *fakeRegistry) push(repo string, tag string, mediaType string, data []byte) {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest] = data
+	r.manifests[repo+":"+tag] = ociManifest{Layers: []ociDescriptor{{MediaType: mediaType, Digest: digest, Size: int64(len(data))}}}
+}
+
+// expireTokens makes every token handed out so far invalid.
+func (r *fakeRegistry) expireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = make(map[string]string)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var repo, kind, ref string
+	for _, sep := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(p, sep); i >= 0 {
+			repo, kind, ref = p[:i], strings.Trim(sep, "/"), p[i+len(sep):]
+			break
+		}
+	}
+	if repo == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	r.mu.Lock()
+	scope, ok := r.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+	r.mu.Unlock()
+	if !ok || scope != "repository:"+repo+":pull" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry",scope="repository:%s:pull"`, r.url, repo))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	manifest, hasManifest := r.manifests[repo+":"+ref]
+	blob, hasBlob := r.blobs[ref]
+	r.mu.Unlock()
+
+	switch {
+	case kind == "manifests" && hasManifest:
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		json.NewEncoder(w).Encode(manifest)
+	case kind == "blobs" && hasBlob:
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if service := req.URL.Query().Get("service"); service != "fake-registry" {
+		r.t.Errorf("token requested for service %q", service)
+	}
+	scope := req.URL.Query().Get("scope")
+
+	r.mu.Lock()
+	r.nTokens++
+	token := fmt.Sprintf("token-%d", r.nTokens)
+	r.tokens[token] = scope
+	r.scopes = append(r.scopes, scope)
+	r.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func newTestOciFileSource(t *testing.T, r *fakeRegistry) *OciFileSource {
+	src := &OciFileSource{
+		Registry:       r.url,
+		Namespace:      "mirrors",
+		TimeoutSeconds: 5,
+	}
+	if err := src.Init(); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	return src
+}
+
+func TestOciFileSourceReadsRepodata(t *testing.T) {
+	r := newFakeRegistry(t)
+	r.push("mirrors/conda-forge/noarch/repodata.json", "latest", OciMediaTypeRepodata, []byte(`{"packages": {}}`))
+	src := newTestOciFileSource(t, r)
+
+	rc, err := src.GetFileReadCloser("conda-forge/noarch/repodata.json")
+	if err != nil {
+		t.Fatalf("GetFileReadCloser: %s", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	if string(data) != `{"packages": {}}` {
+		t.Errorf("got %q", data)
+	}
+	if want := []string{"repository:mirrors/conda-forge/noarch/repodata.json:pull"}; strings.Join(r.scopes, " ") != strings.Join(want, " ") {
+		t.Errorf("got tokens for %v, want %v", r.scopes, want)
+	}
+}
+
+func TestOciFileSourceResolvesPackages(t *testing.T) {
+	r := newFakeRegistry(t)
+	pkg := []byte("not really a package")
+	r.push("mirrors/conda-forge/noarch/fake-pkg", "1.0-py_0", OciMediaTypeCondaPackage, pkg)
+	src := newTestOciFileSource(t, r)
+
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"conda-forge/noarch/fake-pkg-1.0-py_0.tar.bz2", true},
+		{"conda-forge/noarch/fake-pkg-1.0-py_0.conda", false},
+		{"conda-forge/noarch/fake-pkg-2.0-py_0.tar.bz2", false},
+		{"conda-forge/noarch/channeldata.json", false},
+	} {
+		got, err := src.FileExists(tc.name)
+		if err != nil {
+			t.Errorf("FileExists(%s): %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("FileExists(%s) = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+
+	checksum, err := src.GetFilePublishedChecksum("conda-forge/noarch/fake-pkg-1.0-py_0.tar.bz2", "sha256")
+	if err != nil {
+		t.Fatalf("GetFilePublishedChecksum: %s", err)
+	}
+	if sum := sha256.Sum256(pkg); checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("got checksum %s", checksum)
+	}
+}
+
+func TestOciFileSourceRangeReadsRenewExpiredTokens(t *testing.T) {
+	r := newFakeRegistry(t)
+	pkg := bytes.Repeat([]byte("0123456789"), 1000)
+	r.push("mirrors/conda-forge/noarch/fake-pkg", "1.0-0", OciMediaTypeCondaPackage2, pkg)
+	src := newTestOciFileSource(t, r)
+
+	ra, size, err := src.GetFileReaderAt("conda-forge/noarch/fake-pkg-1.0-0.conda")
+	if err != nil {
+		t.Fatalf("GetFileReaderAt: %s", err)
+	}
+	defer ra.Close()
+	if size != int64(len(pkg)) {
+		t.Fatalf("got size %d, want %d", size, len(pkg))
+	}
+
+	r.expireTokens()
+
+	p := make([]byte, 5)
+	if _, err = ra.ReadAt(p, 1003); err != nil {
+		t.Fatalf("ReadAt after the token expired: %s", err)
+	}
+	if string(p) != "34567" {
+		t.Errorf("got %q", p)
+	}
+	if r.nTokens != 2 {
+		t.Errorf("got %d tokens handed out, want 2", r.nTokens)
+	}
+}
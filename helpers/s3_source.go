@@ -0,0 +1,410 @@
+package helpers
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/utils"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadSha256 is the hex-encoded sha256sum of an empty request body.
+const emptyPayloadSha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3FileSource serves conda channel files from a bucket of an S3-compatible object store.
+// Objects are addressed path-style i.e. as <Endpoint>/<Bucket>/<Prefix>/<relative location>, which every
+// S3 implementation (AWS, MinIO, Ceph, ...) understands. Requests are signed with AWS Signature Version 4
+// when credentials are configured, and are sent anonymously otherwise.
+//
+// Repodata files are read consistently: if RepodataLockFilename is set, the read waits for the lock object
+// next to the repodata to disappear, and the repodata object is then fetched pinned to the ETag it had when the
+// read started. Should it be replaced mid-way, the read is started over.
+type S3FileSource struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+
+	TempDir                          string
+	RepodataLockFilename             string
+	RepodataLockMaxWaitSeconds       int
+	RepodataLockRetryIntervalSeconds int
+
+	TimeoutSeconds      int
+	MaxRetries          int
+	RetryBackoffSeconds int
+
+	http HttpFileSource
+}
+
+func (s *S3FileSource) Init() error {
+	logger := GetAppLogger()
+
+	if s == nil {
+		return logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	if s.Endpoint == "" || s.Bucket == "" {
+		return logger.ErrorPrintf("both of endpoint and bucket are required for an S3 file source")
+	}
+
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+
+	if err := os.MkdirAll(s.TempDir, 0755); err != nil {
+		return logger.ErrorPrintf("could not create tempdir %s: %s", s.TempDir, err.Error())
+	}
+
+	if s.RepodataLockMaxWaitSeconds < 1 {
+		s.RepodataLockMaxWaitSeconds = 10
+	}
+
+	if s.RepodataLockRetryIntervalSeconds < 1 {
+		s.RepodataLockRetryIntervalSeconds = 1
+	}
+
+	s.http = HttpFileSource{
+		BaseUrl:             strings.TrimSuffix(s.Endpoint, "/") + "/" + path.Join(s.Bucket, s.Prefix),
+		TimeoutSeconds:      s.TimeoutSeconds,
+		MaxRetries:          s.MaxRetries,
+		RetryBackoffSeconds: s.RetryBackoffSeconds,
+		prepareRequest:      s.signRequest,
+	}
+
+	return s.http.Init()
+}
+
+func (s *S3FileSource) GetFileReadCloser(relativeFilepath string) (io.ReadCloser, error) {
+	logger := GetAppLogger()
+
+	if s == nil {
+		return nil, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	if !IsRepodataFile(filepath.Base(relativeFilepath)) {
+		return s.http.GetFileReadCloser(relativeFilepath)
+	}
+
+	if s.RepodataLockFilename != "" {
+		lockFilepath := filepath.Join(filepath.Dir(relativeFilepath), s.RepodataLockFilename)
+		if err := s.waitForLockRelease(lockFilepath); err != nil {
+			return nil, logger.ErrorPrintf("could not read %s: %s", relativeFilepath, err.Error())
+		}
+	}
+
+	maxAttempts := s.RepodataLockMaxWaitSeconds/s.RepodataLockRetryIntervalSeconds + 1
+	for attempt := 1; ; attempt++ {
+		rc, changed, err := s.getFileReadCloserConsistently(relativeFilepath)
+		if !changed {
+			return rc, err
+		}
+		if attempt >= maxAttempts {
+			return nil, logger.ErrorPrintf("could not read %s: object kept changing while being read", relativeFilepath)
+		}
+		logger.Printf("[INFO] Object %s changed while being read; reading it again", relativeFilepath)
+		time.Sleep(time.Duration(s.RepodataLockRetryIntervalSeconds) * time.Second)
+	}
+}
+
+// getFileReadCloserConsistently copies the object to a temporary file, pinning the read to the ETag of
+// the object when the read began. It reports whether the object changed in the meantime, in which case
+// nothing is returned.
+func (s *S3FileSource) getFileReadCloserConsistently(relativeFilepath string) (io.ReadCloser, bool, error) {
+	logger := GetAppLogger()
+
+	fileUrl := s.http.GetFileUrl(relativeFilepath)
+	resp, cancel, err := s.http.do(http.MethodHead, fileUrl, nil, http.StatusOK)
+	if err != nil {
+		return nil, false, logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+	etag := resp.Header.Get("ETag")
+
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, cancel, err = s.http.do(http.MethodGet, fileUrl, header, http.StatusOK, http.StatusPreconditionFailed)
+	if err != nil {
+		return nil, false, logger.ErrorPrintf("could not fetch %s: %s", fileUrl, err.Error())
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, true, nil
+	}
+
+	baseFilename := filepath.Base(relativeFilepath)
+	tmpFile, err := ioutil.TempFile(s.TempDir, ".tmp."+baseFilename+".*")
+	if err != nil {
+		return nil, false, logger.ErrorPrintf("could not create tempfile for copying %s: %s", baseFilename, err.Error())
+	}
+	if _, err = io.Copy(tmpFile, resp.Body); err == nil {
+		_, err = tmpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, false, logger.ErrorPrintf("could not copy %s to tempfile: %s", fileUrl, err.Error())
+	}
+
+	return utils.NewTempFileReadCloser(tmpFile), false, nil
+}
+
+// waitForLockRelease polls for the lock object at lockFilepath until it is gone, or
+// RepodataLockMaxWaitSeconds have passed.
+func (s *S3FileSource) waitForLockRelease(lockFilepath string) error {
+	logger := GetAppLogger()
+
+	deadline := time.Now().Add(time.Duration(s.RepodataLockMaxWaitSeconds) * time.Second)
+	for {
+		locked, err := s.FileExists(lockFilepath)
+		if err != nil {
+			return fmt.Errorf("could not check for lock object %s: %s", lockFilepath, err.Error())
+		}
+		if !locked {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lock object %s was not released within %d seconds", lockFilepath, s.RepodataLockMaxWaitSeconds)
+		}
+		logger.Printf("[DEBUG] Waiting for release of lock object: %s", lockFilepath)
+		time.Sleep(time.Duration(s.RepodataLockRetryIntervalSeconds) * time.Second)
+	}
+}
+
+// FileExists checks for the presence of an object with a HEAD request. Only a 404 means there is none: a 403
+// is an error, be it for bad credentials or for missing objects under credentials without s3:ListBucket, which
+// the source needs to tell these apart (and not to mistake a lock object it cannot read for a released one).
+func (s *S3FileSource) FileExists(relativeFilepath string) (bool, error) {
+	logger := GetAppLogger()
+
+	if s == nil {
+		return false, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	fileUrl := s.http.GetFileUrl(relativeFilepath)
+	resp, cancel, err := s.http.do(http.MethodHead, fileUrl, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return false, logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+	}
+	resp.Body.Close()
+	cancel()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// GetFileFingerprint returns the ETag of an object.
+func (s *S3FileSource) GetFileFingerprint(relativeFilepath string) (string, error) {
+	return s.http.GetFileFingerprint(relativeFilepath)
+}
+
+func (s *S3FileSource) GetFileReaderAt(relativeFilepath string) (domain.ReadAtCloser, int64, error) {
+	return s.http.GetFileReaderAt(relativeFilepath)
+}
+
+// ListDirs lists the common prefixes directly under a "directory" of the bucket with ListObjectsV2.
+func (s *S3FileSource) ListDirs(relativeDirpath string) ([]string, error) {
+	logger := GetAppLogger()
+
+	if s == nil {
+		return nil, logger.ErrorPrintf("called on a nil struct!")
+	}
+
+	prefix := strings.TrimPrefix(path.Join(s.Prefix, filepath.ToSlash(relativeDirpath))+"/", "/")
+
+	var res []string
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		listUrl := strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "?" + query.Encode()
+
+		resp, cancel, err := s.http.do(http.MethodGet, listUrl, nil, http.StatusOK)
+		if err != nil {
+			return nil, logger.ErrorPrintf("could not list objects under %s: %s", prefix, err.Error())
+		}
+
+		var listing struct {
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, logger.ErrorPrintf("could not parse object listing under %s: %s", prefix, err.Error())
+		}
+
+		for _, p := range listing.CommonPrefixes {
+			if name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); name != "" {
+				res = append(res, name)
+			}
+		}
+
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = listing.NextContinuationToken
+	}
+
+	return res, nil
+}
+
+// GetFilePublishedChecksum returns the sha256 checksum S3 keeps for objects uploaded with one, or else
+// reads it from a checksum file published alongside, such as "<file>.sha256".
+func (s *S3FileSource) GetFilePublishedChecksum(relativeFilepath string, checksumType string) (string, error) {
+	logger := GetAppLogger()
+
+	if strings.ToLower(checksumType) == "sha256" {
+		fileUrl := s.http.GetFileUrl(relativeFilepath)
+		header := http.Header{}
+		header.Set("x-amz-checksum-mode", "ENABLED")
+		resp, cancel, err := s.http.do(http.MethodHead, fileUrl, header, http.StatusOK)
+		if err != nil {
+			return "", logger.ErrorPrintf("could not fetch headers for %s: %s", fileUrl, err.Error())
+		}
+		resp.Body.Close()
+		cancel()
+
+		if checksum := resp.Header.Get("x-amz-checksum-sha256"); checksum != "" {
+			if raw, err := base64.StdEncoding.DecodeString(checksum); err == nil {
+				return hex.EncodeToString(raw), nil
+			}
+		}
+	}
+
+	return readPublishedChecksumFile(s, relativeFilepath, checksumType)
+}
+
+// signRequest signs req with AWS Signature Version 4. Requests are left unsigned without credentials.
+// Only bodyless requests are ever sent, so the payload hash is always that of an empty body.
+func (s *S3FileSource) signRequest(req *http.Request) error {
+	return s.signRequestAt(req, time.Now().UTC())
+}
+
+func (s *S3FileSource) signRequestAt(req *http.Request, now time.Time) error {
+	if s.AccessKeyId == "" || s.SecretAccessKey == "" {
+		return nil
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	// Send the path exactly as it is signed
+	req.URL.RawPath = awsUriEscapePath(req.URL.Path)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadSha256)
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+
+	signedHeaderValues := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "if-match" {
+			signedHeaderValues[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	var signedHeaders []string
+	for k := range signedHeaderValues {
+		signedHeaders = append(signedHeaders, k)
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range signedHeaders {
+		canonicalHeaders.WriteString(k + ":" + signedHeaderValues[k] + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		awsCanonicalQuery(req),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		emptyPayloadSha256,
+	}, "\n")
+
+	scope := strings.Join([]string{shortDate, s.Region, "s3", "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), shortDate)
+	signingKey = hmacSha256(signingKey, s.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyId, scope, strings.Join(signedHeaders, ";"), signature))
+
+	return nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsUriEscapePath URI-encodes every byte of p except the unreserved characters and '/', as AWS requires.
+func awsUriEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsCanonicalQuery returns the query string of req with its parameters sorted and encoded as AWS requires.
+func awsCanonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	var params []string
+	for k, vals := range query {
+		for _, v := range vals {
+			params = append(params, strings.Replace(awsUriEscapePath(k), "/", "%2F", -1)+"="+
+				strings.Replace(awsUriEscapePath(v), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"conda-rlookup/domain"
+	"net/url"
+	"os"
+)
+
+// NewChannelFileSource returns an initialized file source for a conda server.
+// If the server has an OCI registry or an S3 bucket configured, the channels are fetched from it;
+// if it has a Url configured, they are fetched remotely over HTTP(S); otherwise they are read
+// from the local directory at Path. Remote sources authenticate with creds, which are usually either
+// the credentials of the server or those of one of its channels.
+func NewChannelFileSource(svr *domain.CondaServer, creds domain.Credentials) (domain.CondaChannelFileSource, error) {
+	if svr.Oci.Registry != "" {
+		ociSrc := OciFileSource{
+			Registry:            svr.Oci.Registry,
+			Namespace:           svr.Oci.Namespace,
+			Credentials:         creds,
+			TimeoutSeconds:      svr.HttpTimeoutSeconds,
+			MaxRetries:          svr.HttpMaxRetries,
+			RetryBackoffSeconds: svr.HttpRetryBackoffSeconds,
+		}
+		if err := ociSrc.Init(); err != nil {
+			return nil, err
+		}
+		return &ociSrc, nil
+	}
+
+	if svr.S3.Bucket != "" {
+		accessKeyId, secretAccessKey := os.Getenv(svr.S3.AccessKeyIdEnv), os.Getenv(svr.S3.SecretAccessKeyEnv)
+		if creds.Type != "" {
+			var host string
+			if u, err := url.Parse(svr.S3.Endpoint); err == nil {
+				host = u.Hostname()
+			}
+			auth, err := resolveCredentials(creds, host)
+			if err != nil {
+				return nil, GetAppLogger().ErrorPrintf("could not resolve credentials for bucket %s: %s", svr.S3.Bucket, err.Error())
+			}
+			if auth.kind != domain.CredentialsBasic {
+				return nil, GetAppLogger().ErrorPrintf("unsupported credentials type %q for an S3 file source: must be %s", creds.Type, domain.CredentialsBasic)
+			}
+			accessKeyId, secretAccessKey = auth.username, auth.password
+		}
+
+		s3Src := S3FileSource{
+			Endpoint:                         svr.S3.Endpoint,
+			Region:                           svr.S3.Region,
+			Bucket:                           svr.S3.Bucket,
+			Prefix:                           svr.S3.Prefix,
+			AccessKeyId:                      accessKeyId,
+			SecretAccessKey:                  secretAccessKey,
+			SessionToken:                     os.Getenv(svr.S3.SessionTokenEnv),
+			TempDir:                          "/tmp",
+			RepodataLockFilename:             svr.RepodataLockFilename,
+			RepodataLockMaxWaitSeconds:       svr.RepodataLockMaxWaitSeconds,
+			RepodataLockRetryIntervalSeconds: svr.RepodataLockRetryIntervalSeconds,
+			TimeoutSeconds:                   svr.HttpTimeoutSeconds,
+			MaxRetries:                       svr.HttpMaxRetries,
+			RetryBackoffSeconds:              svr.HttpRetryBackoffSeconds,
+		}
+		if err := s3Src.Init(); err != nil {
+			return nil, err
+		}
+		return &s3Src, nil
+	}
+
+	if svr.Url != "" {
+		httpSrc := HttpFileSource{
+			BaseUrl:             svr.Url,
+			Credentials:         creds,
+			TimeoutSeconds:      svr.HttpTimeoutSeconds,
+			MaxRetries:          svr.HttpMaxRetries,
+			RetryBackoffSeconds: svr.HttpRetryBackoffSeconds,
+		}
+		if err := httpSrc.Init(); err != nil {
+			return nil, err
+		}
+		return &httpSrc, nil
+	}
+
+	localSrc := LocalFileSource{
+		TempDir:                          "/tmp",
+		RepodataLockFilename:             svr.RepodataLockFilename,
+		RepodataLockMaxWaitSeconds:       20,
+		RepodataLockRetryIntervalSeconds: 2,
+		SourceDir:                        svr.Path,
+	}
+
+	if svr.RepodataLockMaxWaitSeconds > 0 {
+		localSrc.RepodataLockMaxWaitSeconds = svr.RepodataLockMaxWaitSeconds
+	}
+
+	if svr.RepodataLockRetryIntervalSeconds > 0 {
+		localSrc.RepodataLockRetryIntervalSeconds = svr.RepodataLockRetryIntervalSeconds
+	}
+
+	if err := localSrc.Init(); err != nil {
+		return nil, err
+	}
+	return &localSrc, nil
+}
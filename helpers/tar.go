@@ -11,32 +11,24 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
-// TarBz2ExtractFilesAndGetChecksum reads a tar.bz2 stream and tries extracting a set of "allowed-files"
-// from the archive into destDir while also trying to calculate the checksum (sha256 or md5) of the stream.
-// The checksum is returned as a hex-encoded string, along with error, if any.
+// TarBz2ExtractFilesAndGetChecksum reads a tar.bz2 stream and tries extracting a set of "allowed-files",
+// which may be globs, from the archive into destDir while also trying to calculate the checksum (sha256 or md5)
+// of the stream. The checksum is returned as a hex-encoded string, along with error, if any.
+// Every regular file in the archive is passed to visit, unless it is nil.
 // destDir is created if it does not already exist.
 // If there are no errors, srcReader is guaranteed to be read till EOF.
 // In case of errors, the state of destDir is unknown.
-func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allowedFiles []string, checksumType string) (string, error) {
+func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allowedFiles []string, visit TarEntryVisitor, checksumType string) (string, error) {
 	logger := GetAppLogger()
 
-	fileIsAllowed := make(map[string]bool)
-	for _, flname := range allowedFiles {
-		fileIsAllowed[filepath.Join(destDir, flname)] = true
-	}
-
-	var hasher hash.Hash
-	switch strings.ToLower(checksumType) {
-	case "md5", "md5sum":
-		hasher = md5.New()
-	case "sha256", "sha", "shasum", "sha256sum":
-		hasher = sha256.New()
-	default:
-		return "", fmt.Errorf("Unknown checksum type %s: must be one of {sha256, md5}", checksumType)
+	hasher, err := newHasher(checksumType)
+	if err != nil {
+		return "", err
 	}
 
 	// Legend:
@@ -57,6 +49,51 @@ func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allow
 	bz2Decomp := bzip2.NewReader(teeReader)
 	tr := tar.NewReader(bz2Decomp)
 
+	if err := extractAllowedFilesFromTar(tr, destDir, allowedFiles, visit); err != nil {
+		return "", err
+	}
+
+	// This is necessary to drain the ENTIRE tarbz2 file into the hasher
+	// so that the correct checksum is calculated
+	if _, err := io.Copy(ioutil.Discard, teeReader); err != nil {
+		return "", logger.ErrorPrintf("Unable to read file fully for hashing: %s", err.Error())
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// newHasher returns a hash.Hash for the given checksum type (sha256 or md5).
+func newHasher(checksumType string) (hash.Hash, error) {
+	switch strings.ToLower(checksumType) {
+	case "md5", "md5sum":
+		return md5.New(), nil
+	case "sha256", "sha", "shasum", "sha256sum":
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("Unknown checksum type %s: must be one of {sha256, md5}", checksumType)
+	}
+}
+
+// TarEntryVisitor is called with the cleaned, slash-separated name, the header and the content of a regular
+// file in a package archive, as the archive is being read. It need not read the content till the end.
+type TarEntryVisitor func(name string, header *tar.Header, r io.Reader) error
+
+// extractAllowedFilesFromTar walks through all the entries of tr and extracts the regular files
+// that match any of allowedFiles, which are globs as understood by MatchPathGlob, into destDir.
+// Every regular file, extracted or not, is passed to visit as well, unless it is nil.
+// tr is read till the end of the archive.
+func extractAllowedFilesFromTar(tr *tar.Reader, destDir string, allowedFiles []string, visit TarEntryVisitor) error {
+	logger := GetAppLogger()
+
+	fileIsAllowed := func(name string) bool {
+		for _, pattern := range allowedFiles {
+			if MatchPathGlob(pattern, name) {
+				return true
+			}
+		}
+		return false
+	}
+
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -64,7 +101,7 @@ func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allow
 		}
 
 		if err != nil {
-			return "", logger.ErrorPrintf("failed reading archive: %s", err)
+			return logger.ErrorPrintf("failed reading archive: %s", err)
 		}
 
 		// if the header is nil, just skip it (not sure how this happens)
@@ -73,10 +110,17 @@ func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allow
 		}
 
 		// the target location where the dir/file should be created
-		target := filepath.Join(destDir, header.Name)
-		if !fileIsAllowed[target] {
+		// (rooted before cleaning, so that no entry ends up outside destDir)
+		name := path.Clean("/" + header.Name)[1:]
+		if !fileIsAllowed(name) {
+			if visit != nil && header.Typeflag == tar.TypeReg {
+				if err := visit(name, header, tr); err != nil {
+					return logger.ErrorPrintf("could not visit file %s: %s", name, err.Error())
+				}
+			}
 			continue
 		}
+		target := filepath.Join(destDir, filepath.FromSlash(name))
 		logger.Printf("[DEBUG] Extracting file %s\n", target)
 
 		// check the file type
@@ -84,18 +128,26 @@ func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allow
 			parentDir := filepath.Dir(target)
 			if _, err := os.Stat(parentDir); err != nil {
 				if err := os.MkdirAll(parentDir, 0755); err != nil {
-					return "", logger.ErrorPrintf("could not create dir %s: %s", parentDir, err.Error())
+					return logger.ErrorPrintf("could not create dir %s: %s", parentDir, err.Error())
 				}
 			}
 
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
-				return "", logger.ErrorPrintf("could not create file %s: %s", target, err.Error())
+				return logger.ErrorPrintf("could not create file %s: %s", target, err.Error())
 			}
 
-			// copy over contents
+			// let visit see the contents as they are copied over
+			if visit != nil {
+				if err := visit(name, header, io.TeeReader(tr, f)); err != nil {
+					f.Close()
+					return logger.ErrorPrintf("could not visit file %s: %s", name, err.Error())
+				}
+			}
+
+			// copy over (the rest of the) contents
 			if _, err := io.Copy(f, tr); err != nil {
-				return "", logger.ErrorPrintf("could not write to file %s: %s", target, err.Error())
+				return logger.ErrorPrintf("could not write to file %s: %s", target, err.Error())
 			}
 
 			// manually close here after each file operation; defering would cause each file close
@@ -104,11 +156,5 @@ func TarBz2ExtractFilesAndGetChecksum(srcReader io.Reader, destDir string, allow
 		}
 	}
 
-	// This is necessary to drain the ENTIRE tarbz2 file into the hasher
-	// so that the correct checksum is calculated
-	if _, err := io.Copy(ioutil.Discard, teeReader); err != nil {
-		return "", logger.ErrorPrintf("Unable to read file fully for hashing: %s", err.Error())
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+	return nil
 }
@@ -0,0 +1,180 @@
+package indexer
+
+import (
+	"archive/tar"
+	"bytes"
+	"conda-rlookup/helpers"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// The findings of deep-scanning a package go into the metadata document as they are, and are kept in its
+// directory so that the document can be generated again without fetching the package.
+const deepScanFilename = "deepscan.json"
+
+// deepScanner looks into the files of a package as it is being extracted.
+type deepScanner struct {
+	maxFileBytes int64
+
+	// What to look for: sonames and Python distributions for the metadata document, and exported symbols
+	// for the symbols file
+	sonames bool
+	symbols bool
+	pypi    bool
+
+	providesSonames map[string]bool
+	needsSonames    map[string]bool
+	exportedSymbols map[string]bool // symbols file lines
+	pypiNames       map[string]pypiDistribution
+}
+
+func newDeepScanner(maxFileBytes int64, settings extractionSettings) *deepScanner {
+	return &deepScanner{
+		maxFileBytes:    maxFileBytes,
+		sonames:         settings.DeepScan,
+		symbols:         settings.ExportedSymbols,
+		pypi:            settings.PypiNames,
+		providesSonames: make(map[string]bool),
+		needsSonames:    make(map[string]bool),
+		exportedSymbols: make(map[string]bool),
+		pypiNames:       make(map[string]pypiDistribution),
+	}
+}
+
+// visit is a helpers.TarEntryVisitor that records the SONAME and NEEDED entries of ELF files, the symbols
+// exported by shared libraries and the Python distributions installed into site-packages.
+func (d *deepScanner) visit(name string, header *tar.Header, r io.Reader) error {
+	if d.pypi && isPythonDistributionMetadata(name) {
+		return d.visitPythonDistributionMetadata(name, r)
+	}
+	if d.sonames || d.symbols {
+		return d.visitElf(name, header, r)
+	}
+	return nil
+}
+
+// visitElf looks into ELF files. Files that are larger than maxFileBytes, or that cannot be parsed, are passed over.
+func (d *deepScanner) visitElf(name string, header *tar.Header, r io.Reader) error {
+	logger := helpers.GetAppLogger()
+
+	magic := make([]byte, 4)
+	if n, err := io.ReadFull(r, magic); err != nil || !helpers.IsElfHeader(magic[:n]) {
+		return nil
+	}
+	if header.Size > d.maxFileBytes {
+		logger.Printf("[DEBUG] Not scanning ELF file %s of %d bytes", name, header.Size)
+		return nil
+	}
+
+	// The size in the header is not to be trusted, so the file is spooled as it is read, up to the limit. It is
+	// parsed from the spool file rather than from memory, for workers not to hold up to the limit each.
+	spoolFile, err := ioutil.TempFile("", ".tmp.elf.*")
+	if err != nil {
+		return logger.ErrorPrintf("could not create tempfile for spooling ELF file %s: %s", name, err.Error())
+	}
+	defer os.Remove(spoolFile.Name())
+	defer spoolFile.Close()
+
+	size, err := io.Copy(spoolFile, io.MultiReader(bytes.NewReader(magic), io.LimitReader(r, d.maxFileBytes-int64(len(magic))+1)))
+	if err != nil {
+		return logger.ErrorPrintf("could not spool ELF file %s to tempfile %s: %s", name, spoolFile.Name(), err.Error())
+	}
+	if size > d.maxFileBytes {
+		logger.Printf("[DEBUG] Not scanning ELF file %s of more than %d bytes", name, d.maxFileBytes)
+		return nil
+	}
+	info, err := helpers.ReadElfDynamicInfo(io.NewSectionReader(spoolFile, 0, size), d.symbols)
+	if err != nil {
+		logger.Printf("[DEBUG] Could not read ELF file %s: %s", name, err.Error())
+		return nil
+	}
+
+	if info.Soname != "" {
+		d.providesSonames[info.Soname] = true
+	}
+	for _, lib := range info.Needed {
+		d.needsSonames[lib] = true
+	}
+	// Position-independent executables export symbols too, but only libraries are linked against
+	if info.SharedObject && (info.Soname != "" || strings.Contains(path.Base(name), ".so")) {
+		for _, sym := range info.Exported {
+			d.exportedSymbols[sym.Name+"\t"+sym.Version+"\t"+name] = true
+		}
+	}
+	return nil
+}
+
+// document returns what goes into the metadata document from the files scanned so far, which is nothing
+// unless d looks for sonames or Python distributions.
+func (d *deepScanner) document() map[string]interface{} {
+	res := make(map[string]interface{})
+	if d.sonames {
+		res["provides_sonames"] = sortedKeys(d.providesSonames)
+		res["needs_sonames"] = sortedKeys(d.needsSonames)
+	}
+	if d.pypi {
+		res["pypi_names"] = d.pythonDistributions()
+	}
+	return res
+}
+
+// writeDeepScan writes the document of d into prefixDir, or removes the one there if d is nil or there is
+// nothing in its document.
+func writeDeepScan(prefixDir string, d *deepScanner) error {
+	logger := helpers.GetAppLogger()
+
+	filename := filepath.Join(prefixDir, deepScanFilename)
+	if d == nil || len(d.document()) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return logger.ErrorPrintf("could not remove %s: %s", filename, err.Error())
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(d.document())
+	if err != nil {
+		return logger.ErrorPrintf("could not serialize deep scan of %s: %s", prefixDir, err.Error())
+	}
+	if err = renameio.WriteFile(filename, data, 0644); err != nil {
+		return logger.ErrorPrintf("could not write %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// addDeepScanToDocument adds the deep scan kept in prefixDir, if there is one, to the metadata document res.
+func addDeepScanToDocument(prefixDir string, res map[string]interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(prefixDir, deepScanFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for k, v := range doc {
+		res[k] = v
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of set in order. It never returns nil.
+func sortedKeys(set map[string]bool) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,67 @@
+package indexer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/libdstest.so.1 is a shared library built from
+//
+//	double dstest_hypot(double x, double y) { return sqrt(x * x + y * y); }
+//
+// with gcc -shared -fPIC -Wl,-soname,libdstest.so.1 -Wl,--no-as-needed ... -lm, and stripped.
+func TestDeepScannerReadsElfFiles(t *testing.T) {
+	elf, err := ioutil.ReadFile(filepath.Join("testdata", "libdstest.so.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc         string
+		maxFileBytes int64
+		sonames      []string
+		needs        []string
+		symbols      []string
+	}{
+		{"within the limit", int64(len(elf)), []string{"libdstest.so.1"}, []string{"libc.so.6", "libm.so.6"},
+			[]string{"dstest_hypot\t\tlib/libdstest.so.1"}},
+		{"beyond the limit", int64(len(elf)) - 1, []string{}, []string{}, []string{}},
+	} {
+		d := newDeepScanner(tc.maxFileBytes, extractionSettings{DeepScan: true, ExportedSymbols: true})
+		header := &tar.Header{Name: "lib/libdstest.so.1", Size: int64(len(elf)), Typeflag: tar.TypeReg}
+		if err = d.visit("lib/libdstest.so.1", header, bytes.NewReader(elf)); err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+
+		doc := d.document()
+		if !reflect.DeepEqual(doc["provides_sonames"], tc.sonames) || !reflect.DeepEqual(doc["needs_sonames"], tc.needs) {
+			t.Errorf("%s: got document %v, want sonames %v and needs %v", tc.desc, doc, tc.sonames, tc.needs)
+		}
+		if got := sortedKeys(d.exportedSymbols); !reflect.DeepEqual(got, tc.symbols) {
+			t.Errorf("%s: got symbols %q, want %q", tc.desc, got, tc.symbols)
+		}
+	}
+}
+
+func TestDeepScannerDoesNotTrustTarHeaderSizes(t *testing.T) {
+	elf := append([]byte("\x7fELF"), make([]byte, 60)...)
+	for _, tc := range []struct {
+		name         string
+		maxFileBytes int64
+		headerSize   int64
+	}{
+		{"size claimed beyond any allocation", 1 << 62, 1 << 61},
+		{"size claimed within the limit, file beyond it", 32, 16},
+	} {
+		d := newDeepScanner(tc.maxFileBytes, extractionSettings{DeepScan: true})
+		header := &tar.Header{Name: "lib/libfoo.so", Size: tc.headerSize, Typeflag: tar.TypeReg}
+		if err := d.visit("lib/libfoo.so", header, bytes.NewReader(elf)); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiscoverSubdirs walks src from its root, up to cfg.MaxDepth levels deep, looking for subdirs i.e.
+// directories that hold repodata.json in any of the given compressions. It returns the relative locations
+// of the subdirs that pass the include/exclude globs of cfg, sorted. Hidden directories are never walked.
+func DiscoverSubdirs(src domain.CondaChannelFileSource, cfg domain.DiscoveryConfig, compressions []string) ([]string, error) {
+	logger := helpers.GetAppLogger()
+
+	// Globs are checked up front, as a malformed one would otherwise just never match
+	for _, glob := range append(append([]string(nil), cfg.Include...), cfg.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, logger.ErrorPrintf("invalid include/exclude glob %q: %s", glob, err.Error())
+		}
+	}
+
+	lister, ok := src.(domain.CondaChannelDirLister)
+	if !ok {
+		return nil, logger.ErrorPrintf("the file source does not support listing directories")
+	}
+
+	if len(compressions) == 0 {
+		compressions = []string{""}
+	}
+
+	var res []string
+	dirs := []string{""}
+	for depth := 0; depth <= cfg.MaxDepth && len(dirs) > 0; depth++ {
+		var nextDirs []string
+		for _, dir := range dirs {
+			if dir != "" {
+				isSubdir, err := dirHoldsRepodata(src, dir, compressions)
+				if err != nil {
+					return nil, err
+				}
+				if isSubdir {
+					if subdirMatchesGlobs(dir, cfg.Include, cfg.Exclude) {
+						logger.Printf("[INFO] Discovered subdirectory: %s", dir)
+						res = append(res, dir)
+					} else {
+						logger.Printf("[DEBUG] Ignoring discovered subdirectory %s as per include/exclude globs", dir)
+					}
+					continue
+				}
+			}
+
+			if depth == cfg.MaxDepth {
+				continue
+			}
+
+			children, err := lister.ListDirs(dir)
+			if err != nil {
+				return nil, logger.ErrorPrintf("could not list directory %q: %s", dir, err.Error())
+			}
+			for _, child := range children {
+				if !strings.HasPrefix(child, ".") {
+					nextDirs = append(nextDirs, path.Join(dir, child))
+				}
+			}
+		}
+		dirs = nextDirs
+	}
+
+	sort.Strings(res)
+	return res, nil
+}
+
+// MergeDiscoveredSubdirs adds the discovered subdirs to channels, which are keyed by name, and returns it.
+// The parent directory of a subdir is its channel. Subdirs (and channels) are matched by relative location,
+// so the ones already present in channels are left untouched along with their settings, such as ExtraData.
+func MergeDiscoveredSubdirs(channels map[string]domain.Channel, subdirs []string) map[string]domain.Channel {
+	if channels == nil {
+		channels = make(map[string]domain.Channel)
+	}
+
+	channelKeys := make(map[string]string)
+	for key, ch := range channels {
+		channelKeys[filepath.Clean(ch.RelativeLocation)] = key
+	}
+
+	for _, subdirLocation := range subdirs {
+		chLocation := filepath.Dir(subdirLocation)
+
+		chKey, ok := channelKeys[chLocation]
+		if !ok {
+			chKey = chLocation
+			channels[chKey] = domain.Channel{
+				Name:             filepath.Base(chLocation),
+				RelativeLocation: chLocation,
+				Subdirs:          make(map[string]domain.Subdir),
+			}
+			channelKeys[chLocation] = chKey
+		}
+
+		ch := channels[chKey]
+		if ch.Subdirs == nil {
+			ch.Subdirs = make(map[string]domain.Subdir)
+		}
+
+		alreadyConfigured := false
+		for _, subdir := range ch.Subdirs {
+			if filepath.Clean(subdir.RelativeLocation) == subdirLocation {
+				alreadyConfigured = true
+				break
+			}
+		}
+
+		if !alreadyConfigured {
+			name := filepath.Base(subdirLocation)
+			subdirKey := name
+			if _, clash := ch.Subdirs[subdirKey]; clash {
+				subdirKey = subdirLocation
+			}
+			ch.Subdirs[subdirKey] = domain.Subdir{
+				Name:             name,
+				RelativeLocation: subdirLocation,
+			}
+		}
+
+		channels[chKey] = ch
+	}
+
+	return channels
+}
+
+// dirHoldsRepodata tells if there is a repodata.json in any of the given compressions in dir.
+func dirHoldsRepodata(src domain.CondaChannelFileSource, dir string, compressions []string) (bool, error) {
+	logger := helpers.GetAppLogger()
+
+	for _, suffix := range compressions {
+		fileref := path.Join(dir, "repodata.json"+suffix)
+		exists, err := src.FileExists(fileref)
+		if err != nil {
+			return false, logger.ErrorPrintf("could not check for repodata %s: %s", fileref, err.Error())
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// subdirMatchesGlobs tells if the relative location of a subdir matches any of the include globs
+// (or if there are none) and none of the exclude globs. The globs must have been checked to be well-formed.
+func subdirMatchesGlobs(subdirLocation string, include []string, exclude []string) bool {
+	for _, glob := range exclude {
+		if matched, _ := path.Match(glob, subdirLocation); matched {
+			return false
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+
+	for _, glob := range include {
+		if matched, _ := path.Match(glob, subdirLocation); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverSubdirsChecksGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, subdir := range []string{"main/linux-64", "main/noarch", "forge/linux-64"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, subdir, "repodata.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := &helpers.LocalFileSource{SourceDir: dir, TempDir: t.TempDir()}
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		include []string
+		exclude []string
+		want    string // empty if the globs must be rejected
+	}{
+		{nil, nil, "forge/linux-64 main/linux-64 main/noarch"},
+		{[]string{"main/*"}, []string{"*/noarch"}, "main/linux-64"},
+		{[]string{"main/[a-m]*"}, nil, "main/linux-64"},
+		{[]string{"main/["}, nil, ""},
+		{nil, []string{"*/linux-64", "main/[!"}, ""},
+		{[]string{`main/\`}, nil, ""},
+	} {
+		cfg := domain.DiscoveryConfig{MaxDepth: 2, Include: tc.include, Exclude: tc.exclude}
+		got, err := DiscoverSubdirs(src, cfg, []string{""})
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("include %v, exclude %v: got no error", tc.include, tc.exclude)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("include %v, exclude %v: %s", tc.include, tc.exclude, err)
+			continue
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("include %v, exclude %v: got %v, want %s", tc.include, tc.exclude, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"conda-rlookup/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// The executables of the packages of a subdir, i.e. what a command-not-found handler looks up, are kept in its
+// working directory as "<command>\t<name>\t<package filename>\t<path>" lines in order.
+const executablesFilename = "executables.tsv"
+
+// executableCommand returns the command that runs the file at name of a package, or "" if it is not an
+// executable: files right in bin/ and, on Windows, in Scripts/, where commands are run without their extension.
+func executableCommand(name string) string {
+	dir, base := path.Split(name)
+	switch dir {
+	case "bin/":
+		return base
+	case "Scripts/":
+		for _, ext := range []string{".exe", ".bat", ".cmd"} {
+			if strings.HasSuffix(strings.ToLower(base), ext) {
+				return base[:len(base)-len(ext)]
+			}
+		}
+		return base
+	default:
+		return ""
+	}
+}
+
+// packageExecutableLines returns the lines of the executables file for the package whose metadata document is doc.
+func packageExecutableLines(pkgFilename string, doc map[string]interface{}) []string {
+	var res []string
+	for _, f := range documentFiles(doc) {
+		if command := executableCommand(f); command != "" {
+			res = append(res, strings.Join([]string{command, documentString(doc, "name"), pkgFilename, f}, "\t"))
+		}
+	}
+	return res
+}
+
+// readInExecutablesFile reads the executables file at filename into the lines of every package in it. A missing
+// file is not an error, but is told apart by a nil map.
+func readInExecutablesFile(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		res[fields[2]] = append(res[fields[2]], scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// The sha256sums of the metadata documents the lines of the executables file were generated from, by package
+const executablesSumsFilename = "executables.tsv.sums"
+
+// readInExecutablesSums reads the sums file at filename. A missing file is read as no sums at all.
+func readInExecutablesSums(filename string) (map[string]string, error) {
+	res := make(map[string]string)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// updateExecutablesFile brings the executables file in workDir in line with docSums, the sha256sums of the metadata
+// documents of the packages of the subdir that are indexed, as their kafkadocs have them: the lines of packages no
+// longer indexed are dropped, and those of packages whose sum is not the one they were generated from are
+// regenerated from their metadata document, which is the only one read. Packages whose metadata document cannot be
+// read are left out, and tried again the next time round; an error tells of them once the file is written.
+func updateExecutablesFile(workDir string, docSums map[string]string) error {
+	logger := helpers.GetAppLogger()
+
+	filename := filepath.Join(workDir, executablesFilename)
+	sumsFilename := filepath.Join(workDir, executablesSumsFilename)
+	pkgLines, err := readInExecutablesFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read in executables file %s: %s", filename, err.Error())
+	}
+	sums, err := readInExecutablesSums(sumsFilename)
+	if err != nil {
+		return fmt.Errorf("could not read in executables sums file %s: %s", sumsFilename, err.Error())
+	}
+
+	var lines []string
+	var nLeftOut, nRegenerated int
+	curSums := make(map[string]string)
+	for name, docSum := range docSums {
+		if pkgLines != nil && docSum != "" && sums[name] == docSum {
+			curSums[name] = docSum
+			lines = append(lines, pkgLines[name]...)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(workDir, name, "metadata.json"))
+		if err != nil {
+			logger.Printf("[ERROR] Could not read metadata document of %s for its executables: %s", name, err.Error())
+			nLeftOut += 1
+			continue
+		}
+		// The sum of the document read is the one recorded, should the kafkadoc be missing or behind it
+		sum := sha256.Sum256(data)
+		curSums[name] = hex.EncodeToString(sum[:])
+
+		var doc map[string]interface{}
+		if err = json.Unmarshal(data, &doc); err != nil {
+			logger.Printf("[ERROR] Could not parse metadata document of %s for its executables: %s", name, err.Error())
+			delete(curSums, name)
+			nLeftOut += 1
+			continue
+		}
+		lines = append(lines, packageExecutableLines(name, doc)...)
+		nRegenerated += 1
+	}
+	sort.Strings(lines)
+	logger.Printf("[DEBUG] Regenerated the executables of %d of %d packages in %s", nRegenerated, len(docSums), workDir)
+
+	// The sums are written last, so that they never vouch for lines that were not written
+	var buf bytes.Buffer
+	for _, line := range lines {
+		fmt.Fprintln(&buf, line)
+	}
+	if err = renameio.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %s", filename, err.Error())
+	}
+	data, err := json.Marshal(curSums)
+	if err != nil {
+		return err
+	}
+	if err = renameio.WriteFile(sumsFilename, data, 0644); err != nil {
+		return fmt.Errorf("could not write %s: %s", sumsFilename, err.Error())
+	}
+
+	if nLeftOut > 0 {
+		return fmt.Errorf("left out %d packages whose metadata documents could not be read", nLeftOut)
+	}
+	return nil
+}
+
+// Executable is a command run by an executable of a package.
+type Executable struct {
+	Command string `json:"command"`
+	Name    string `json:"name"`
+	Package string `json:"package"`
+	Path    string `json:"path"`
+}
+
+// ReadSubdirExecutables returns the executables of the packages of the subdir whose working directory is workDir,
+// in order of command. Unless commands is empty, only executables running one of commands are returned.
+func ReadSubdirExecutables(workDir string, commands []string) ([]Executable, error) {
+	filename := filepath.Join(workDir, executablesFilename)
+	pkgLines, err := readInExecutablesFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", filename, err.Error())
+	}
+
+	wanted := make(map[string]bool)
+	addAll(wanted, commands)
+
+	var res []Executable
+	for _, lines := range pkgLines {
+		for _, line := range lines {
+			fields := strings.Split(line, "\t")
+			if len(wanted) > 0 && !wanted[fields[0]] {
+				continue
+			}
+			res = append(res, Executable{Command: fields[0], Name: fields[1], Package: fields[2], Path: fields[3]})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Command != res[j].Command {
+			return res[i].Command < res[j].Command
+		}
+		if res[i].Package != res[j].Package {
+			return res[i].Package < res[j].Package
+		}
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
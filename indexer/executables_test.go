@@ -0,0 +1,64 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeMetadataDocument writes doc as the metadata document of the package name in workDir, and returns its sum.
+func writeMetadataDocument(t *testing.T, workDir string, name string, doc string) string {
+	if err := os.MkdirAll(filepath.Join(workDir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, name, "metadata.json"), []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(doc))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUpdateExecutablesFileOnlyRegeneratesChangedPackages(t *testing.T) {
+	workDir := t.TempDir()
+	docSums := map[string]string{
+		"foo-1.0-0.tar.bz2": writeMetadataDocument(t, workDir, "foo-1.0-0.tar.bz2", `{"name": "foo", "files": ["bin/foo", "lib/libfoo.so"]}`),
+		"bar-1.0-0.conda":   writeMetadataDocument(t, workDir, "bar-1.0-0.conda", `{"name": "bar", "files": ["Scripts/bar.exe"]}`),
+		"baz-1.0-0.conda":   writeMetadataDocument(t, workDir, "baz-1.0-0.conda", `{"name": "baz", "files": ["bin/baz"]}`),
+	}
+	if err := updateExecutablesFile(workDir, docSums); err != nil {
+		t.Fatalf("first updateExecutablesFile: %s", err)
+	}
+
+	// The document of foo is gone, but its sum has not changed, so its lines are kept without reading it. bar has
+	// a new document, and baz is no longer indexed.
+	if err := os.Remove(filepath.Join(workDir, "foo-1.0-0.tar.bz2", "metadata.json")); err != nil {
+		t.Fatal(err)
+	}
+	docSums["bar-1.0-0.conda"] = writeMetadataDocument(t, workDir, "bar-1.0-0.conda", `{"name": "bar", "files": ["Scripts/bar2.cmd"]}`)
+	delete(docSums, "baz-1.0-0.conda")
+	if err := updateExecutablesFile(workDir, docSums); err != nil {
+		t.Fatalf("second updateExecutablesFile: %s", err)
+	}
+
+	got, err := ReadSubdirExecutables(workDir, nil)
+	if err != nil {
+		t.Fatalf("ReadSubdirExecutables: %s", err)
+	}
+	want := []Executable{
+		{Command: "bar2", Name: "bar", Package: "bar-1.0-0.conda", Path: "Scripts/bar2.cmd"},
+		{Command: "foo", Name: "foo", Package: "foo-1.0-0.tar.bz2", Path: "bin/foo"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A package whose sum is not known is read, and left out with an error if it cannot be
+	docSums["foo-1.0-0.tar.bz2"] = ""
+	if err := updateExecutablesFile(workDir, docSums); err == nil {
+		t.Error("got no error for the package whose metadata document is gone")
+	}
+}
@@ -0,0 +1,99 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// packageError is an error in indexing a package along with its class, one of the domain.FailureClass* ones.
+type packageError struct {
+	class string
+	err   error
+}
+
+func (e *packageError) Error() string {
+	return e.err.Error()
+}
+
+// failureClassOf returns the class of an error in indexing a package. Errors without one are extraction errors.
+func failureClassOf(err error) string {
+	if pkgErr, ok := err.(*packageError); ok {
+		return pkgErr.class
+	}
+	return domain.FailureClassExtract
+}
+
+// readInFailureLedger reads the failure ledger of a subdir from filename. An empty ledger is returned if there is none.
+func readInFailureLedger(filename string) (*domain.FailureLedger, error) {
+	logger := helpers.GetAppLogger()
+
+	res := domain.FailureLedger{Failures: make(map[string]domain.PackageFailure)}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &res, nil
+	}
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not open failure ledger %s for reading: %s", filename, err.Error())
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&res); err != nil {
+		return nil, logger.ErrorPrintf("could not read and parse failure ledger %s: %s", filename, err.Error())
+	}
+	if res.Failures == nil {
+		res.Failures = make(map[string]domain.PackageFailure)
+	}
+
+	return &res, nil
+}
+
+func writeFailureLedger(filename string, ledger *domain.FailureLedger) error {
+	logger := helpers.GetAppLogger()
+
+	data, err := json.MarshalIndent(ledger, "", "  ")
+	if err != nil {
+		return logger.ErrorPrintf("could not serialize failure ledger: %s", err.Error())
+	}
+	if err = renameio.WriteFile(filename, data, 0644); err != nil {
+		return logger.ErrorPrintf("could not write failure ledger %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// recordPackageFailure records a failed attempt at indexing package name with the given checksum in ledger, and
+// schedules the next one. Failures of an earlier version of the package, i.e. with another checksum, are discarded.
+func recordPackageFailure(ledger *domain.FailureLedger, name string, checksum string, err error, now time.Time, cfg domain.IndexerConfig) {
+	failure, ok := ledger.Failures[name]
+	if !ok || failure.Checksum != checksum {
+		failure = domain.PackageFailure{
+			Checksum:     checksum,
+			FirstFailure: now,
+		}
+	}
+
+	failure.Class = failureClassOf(err)
+	failure.Error = err.Error()
+	failure.Attempts += 1
+	failure.LastFailure = now
+
+	shift := failure.Attempts - 1
+	if shift > 20 {
+		shift = 20
+	}
+	failure.NextRetry = now.Add(time.Duration(cfg.FailureBackoffSeconds) * time.Second * time.Duration(1<<uint(shift)))
+	failure.Poisoned = cfg.FailureMaxAttempts > 0 && failure.Attempts >= cfg.FailureMaxAttempts
+
+	ledger.Failures[name] = failure
+}
+
+// ReadSubdirFailures returns the failure ledger of the subdir whose working directory is workDir.
+func ReadSubdirFailures(workDir string) (*domain.FailureLedger, error) {
+	return readInFailureLedger(filepath.Join(workDir, "failures.json"))
+}
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// subdirFingerprint returns a fingerprint of everything indexing subdir s depends on: the fingerprints of
+// the repodata files of s in src (repodata.json, or the shard index, and patch instructions), the settings
+// of s and cfg, and the format of metadata documents. As long as it does not change, indexing s again would
+// not change anything. "" is returned, without an error, if src cannot fingerprint files.
+func subdirFingerprint(s domain.Subdir, svrName string, src domain.CondaChannelFileSource, cfg domain.IndexerConfig) (string, error) {
+	fingerprinter, ok := src.(domain.CondaChannelFileFingerprinter)
+	if !ok {
+		return "", nil
+	}
+
+	var files []string
+	if strings.ToLower(cfg.ShardedRepodata) == "true" && strings.ToLower(s.UseRepodataFromPackages) != "true" {
+		indexLocation := filepath.Join(s.RelativeLocation, "repodata_shards.msgpack.zst")
+		exists, err := src.FileExists(indexLocation)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			files = append(files, indexLocation)
+		}
+	}
+	if len(files) == 0 {
+		repodataLocation, err := locateRepodataInSource(s, src, cfg.RepodataCompressions)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, repodataLocation)
+	}
+	if strings.ToLower(cfg.ApplyPatchInstructions) == "true" {
+		files = append(files, filepath.Join(s.RelativeLocation, "patch_instructions.json"))
+	}
+
+	h := sha256.New()
+	for _, fileref := range files {
+		exists, err := src.FileExists(fileref)
+		if err != nil {
+			return "", err
+		}
+		fileFingerprint := "-"
+		if exists {
+			if fileFingerprint, err = fingerprinter.GetFileFingerprint(fileref); err != nil {
+				return "", err
+			}
+			if fileFingerprint == "" {
+				return "", nil
+			}
+		}
+		fmt.Fprintf(h, "%s\t%s\n", fileref, fileFingerprint)
+	}
+
+	// Neither whether unchanged subdirs are skipped nor how packages are processed has a bearing
+	// on the result of indexing them
+	cfg.SkipUnchanged = ""
+	cfg.PackageWorkers = 0
+	cfg.CheckpointPackages = 0
+	cfg.CheckpointSeconds = 0
+	cfg.FailureBackoffSeconds = 0
+	cfg.FailureMaxAttempts = 0
+	settings, err := json.Marshal(struct {
+		Server         string               `json:"server"`
+		Subdir         domain.Subdir        `json:"subdir"`
+		Indexer        domain.IndexerConfig `json:"indexer"`
+		DocumentFormat int                  `json:"document_format"`
+	}{svrName, s, cfg, metadataDocumentFormat})
+	if err != nil {
+		return "", err
+	}
+	h.Write(settings)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readInFingerprintFile returns the fingerprint recorded in filename, or "" if there is none.
+func readInFingerprintFile(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
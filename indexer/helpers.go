@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -70,15 +71,13 @@ func readInRepodataFile(filename string) (*domain.CondaRepodata, error) {
 		}
 		defer f.Close()
 
-		res := domain.CondaRepodata{
-			Packages: make(map[string]domain.CondaPackage),
-		}
+		res := domain.NewCondaRepodata()
 
 		if err = json.NewEncoder(f).Encode(res); err != nil {
 			return nil, logger.ErrorPrintf("could not write empty conda repodata to historic repodata file: %s", err.Error())
 		}
 
-		return &res, nil
+		return res, nil
 	}
 
 	logger.Printf("[DEBUG] Opening repodata file: %s", filename)
@@ -106,13 +105,50 @@ func readInRepodataFromSource(fileref string, src domain.CondaChannelFileSource)
 	}
 	defer repodataReader.Close()
 
-	repodata, err := readCondaRepodata(repodataReader)
+	decompReader, err := helpers.NewDecompressingReadCloser(fileref, repodataReader)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not decompress repodata %s: %s", fileref, err.Error())
+	}
+	defer decompReader.Close()
+
+	repodata, err := readCondaRepodata(decompReader)
 	if err != nil {
 		return nil, logger.ErrorPrintf("could not read repodata %s: %s", fileref, err.Error())
 	}
 	return repodata, nil
 }
 
+// locateRepodataInSource returns the location of the repodata file to index for subdir s in src.
+// Depending on the subdir configuration that is either repodata.json or repodata_from_packages.json,
+// and the first of its variants (by compression suffix) in the order of preference of compressions
+// that is present in src is picked.
+func locateRepodataInSource(s domain.Subdir, src domain.CondaChannelFileSource, compressions []string) (string, error) {
+	logger := helpers.GetAppLogger()
+
+	repodataFilename := "repodata.json"
+	if strings.ToLower(s.UseRepodataFromPackages) == "true" {
+		repodataFilename = "repodata_from_packages.json"
+	}
+
+	if len(compressions) == 0 {
+		compressions = []string{""}
+	}
+
+	for _, suffix := range compressions {
+		fileref := filepath.Join(s.RelativeLocation, repodataFilename+suffix)
+		exists, err := src.FileExists(fileref)
+		if err != nil {
+			return "", logger.ErrorPrintf("could not check for repodata %s: %s", fileref, err.Error())
+		}
+		if exists {
+			return fileref, nil
+		}
+	}
+
+	return "", logger.ErrorPrintf("could not find %s in %s with any of the compressions %q",
+		repodataFilename, s.RelativeLocation, compressions)
+}
+
 func readCondaRepodata(r io.Reader) (*domain.CondaRepodata, error) {
 	logger := helpers.GetAppLogger()
 
@@ -10,6 +10,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/renameio"
 )
@@ -21,8 +26,8 @@ import (
 // The working directory is assumed to be prefixDir. In this subtree, the RelativeLocation of the subdir
 // is used further to segment the cache. svrName is the server-name that is prepended to the "id" that is
 // populated in the metadata, and src could be either a local or a remote file source for fetching repodata files
-// and packages files.
-func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.CondaChannelFileSource) error {
+// and packages files. cfg holds the server-wide indexing settings.
+func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.CondaChannelFileSource, cfg domain.IndexerConfig) error {
 	logger := helpers.GetAppLogger()
 
 	// Create Working directory, if required
@@ -36,6 +41,22 @@ func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.C
 	//TODO: Make historic repodata filename configurable
 	histRepodataFilename := filepath.Join(workDir, "repodata.json.history")
 	curKafkadocsFilename := filepath.Join(workDir, "kafkadocs.json")
+	fingerprintFilename := filepath.Join(workDir, "repodata.json.fingerprint")
+	failureLedgerFilename := filepath.Join(workDir, "failures.json")
+
+	// Nothing to do if the repodata has not changed since the last run that went through without failures
+	fingerprint, err := subdirFingerprint(s, svrName, src, cfg)
+	if err != nil {
+		logger.Printf("[ERROR] Could not fingerprint repodata of %s, so it is not skipped even if unchanged: %s", s.RelativeLocation, err.Error())
+		fingerprint = ""
+	}
+	if strings.ToLower(cfg.SkipUnchanged) == "true" && fingerprint != "" && fingerprint == readInFingerprintFile(fingerprintFilename) {
+		logger.Printf("[INFO] Skipping subdirectory %s as its repodata has not changed since it was last indexed", s.RelativeLocation)
+		return nil
+	}
+	if err = os.Remove(fingerprintFilename); err != nil && !os.IsNotExist(err) {
+		return logger.ErrorPrintf("could not remove stale fingerprint file %s: %s", fingerprintFilename, err.Error())
+	}
 
 	// repodataTempFile is used for writing the incremental updates to history file.
 	// Once the indexing is complete this file is simply rename to the repodata histroy file.
@@ -60,11 +81,42 @@ func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.C
 		return logger.ErrorPrintf("could not read in historic repodata file %s: %s", histRepodataFilename, err.Error())
 	}
 
-	// Get the current repodata reader file
-	curRepodataLocation := filepath.Join(s.RelativeLocation, "repodata.json")
-	curRepodata, err := readInRepodataFromSource(curRepodataLocation, src)
-	if err != nil {
-		return logger.ErrorPrintf("could not read in current repodata %s: %s", curRepodataLocation, err.Error())
+	// Get the current repodata, from its shards if the subdir is sharded
+	var curRepodata *domain.CondaRepodata
+	var curRepodataLocation string
+	if strings.ToLower(cfg.ShardedRepodata) == "true" && strings.ToLower(s.UseRepodataFromPackages) != "true" {
+		curRepodata, curRepodataLocation, err = readInRepodataFromShards(s, src, workDir)
+		if err != nil {
+			return logger.ErrorPrintf("could not read in sharded repodata of %s: %s", s.RelativeLocation, err.Error())
+		}
+	}
+	if curRepodata == nil {
+		curRepodataLocation, err = locateRepodataInSource(s, src, cfg.RepodataCompressions)
+		if err != nil {
+			return logger.ErrorPrintf("could not locate current repodata: %s", err.Error())
+		}
+		if strings.ToLower(cfg.Jlap) == "true" && strings.ToLower(s.UseRepodataFromPackages) != "true" {
+			curRepodata, err = readInRepodataWithJlap(s, src, workDir, curRepodataLocation)
+		} else {
+			curRepodata, err = readInRepodataFromSource(curRepodataLocation, src)
+		}
+		if err != nil {
+			return logger.ErrorPrintf("could not read in current repodata %s: %s", curRepodataLocation, err.Error())
+		}
+	}
+
+	// Patch the current repodata so that it matches what conda clients see
+	if strings.ToLower(cfg.ApplyPatchInstructions) == "true" {
+		patchInstructions, err := readInPatchInstructionsFromSource(s, src)
+		if err != nil {
+			return logger.ErrorPrintf("could not read in patch instructions for %s: %s", s.RelativeLocation, err.Error())
+		}
+		if patchInstructions != nil {
+			logger.Printf("[INFO] Applying patch instructions to repodata %s", curRepodataLocation)
+			applyPatchInstructions(curRepodata, patchInstructions)
+		} else {
+			logger.Printf("[INFO] No patch instructions found for subdirectory %s", s.RelativeLocation)
+		}
 	}
 
 	curKafkadocs, err := readInKafkadocsFile(curKafkadocsFilename)
@@ -73,59 +125,132 @@ func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.C
 	}
 
 	// Start with a black success state; add no-ops and successful updates as we progress
-	successRepodata := domain.CondaRepodata{Packages: make(map[string]domain.CondaPackage)}
+	successRepodata := domain.NewCondaRepodata()
+
+	// .tar.bz2 and .conda packages are indexed alike
+	histPackages := histRepodata.AllPackages()
+	curPackages := curRepodata.AllPackages()
+
+	// Packages that conda refuses to install are dropped from the index: the ones in the "removed" list and,
+	// unless they are to be flagged as such in the metadata documents, the revoked ones.
+	var nRemoved, nRevoked int
+	for _, name := range curRepodata.Removed {
+		if _, ok := curPackages[name]; ok {
+			delete(curPackages, name)
+			nRemoved += 1
+		}
+	}
+	for name, pkg := range curPackages {
+		if isPackageRevoked(pkg) {
+			nRevoked += 1
+			if strings.ToLower(cfg.RevokedPackages) == domain.RevokedPackagesDelete {
+				delete(curPackages, name)
+			}
+		}
+	}
+
+	// Packages that failed before are retried with a backoff, if at all
+	ledger, err := readInFailureLedger(failureLedgerFilename)
+	if err != nil {
+		return logger.ErrorPrintf("could not read in failure ledger %s: %s", failureLedgerFilename, err.Error())
+	}
+	for name := range ledger.Failures {
+		if _, ok := curPackages[name]; !ok {
+			delete(ledger.Failures, name)
+		}
+	}
 
 	// Statistics
-	var nOldPackages, nCurPackages, nSkipped, nUpdated, nDeleted, nFailed, nUpToDate int
-	nOldPackages = len(histRepodata.Packages)
-	nCurPackages = len(curRepodata.Packages)
+	var nOldPackages, nCurPackages, nSkipped, nUpdated, nDeleted, nFailed, nUpToDate, nDeferred, nPoisoned int
+	nOldPackages = len(histPackages)
+	nCurPackages = len(curPackages)
+
+	// Do updates on current - historic, cfg.PackageWorkers packages at a time. Packages are handed out in
+	// sorted order; the statistics, successRepodata and curKafkadocs are only ever updated under mu.
+	names := make([]string, 0, len(curPackages))
+	for name := range curPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	// Do updates on current - historic
-	for name, pkg := range curRepodata.Packages {
-		updateRequired, checksumType, newChecksum, err := updateRequiredDueToChecksumDiff(histRepodata.Packages[name], pkg)
-		if err != nil {
-			nSkipped += 1
-			logger.Printf("[ERROR] Skipping package %s: %s", name, err.Error())
-			continue
-		}
+	nWorkers := cfg.PackageWorkers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
 
-		if updateRequired {
-			nFailed += 1 // Assume it'll fail. If we reach the end and it doesn't decrement the count then
+	// Progress is checkpointed every cfg.CheckpointPackages changed (updated or failed) packages or
+	// cfg.CheckpointSeconds seconds, so that a run that is cut short can be resumed from where it stopped.
+	// Packages that are up to date change nothing, and do not make a checkpoint worth writing.
+	processed := make(map[string]bool)
+	var nSinceCheckpoint int
+	lastCheckpoint := time.Now()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				mu.Lock()
+				var failure *domain.PackageFailure
+				if f, ok := ledger.Failures[name]; ok {
+					failure = &f
+				}
+				mu.Unlock()
+
+				res := indexPackage(s, workDir, svrName, src, cfg, name, histPackages[name], curPackages[name], failure)
+
+				mu.Lock()
+				switch res.outcome {
+				case packageSkipped:
+					nSkipped += 1
+				case packageFailed:
+					nFailed += 1
+					nSinceCheckpoint += 1
+					recordPackageFailure(ledger, name, res.checksum, res.err, time.Now(), cfg)
+				case packageDeferred:
+					nDeferred += 1
+				case packagePoisoned:
+					nPoisoned += 1
+				case packageUpdated:
+					nUpdated += 1
+					nSinceCheckpoint += 1
+					curKafkadocs.Docs[res.id] = res.kafkadoc
+					successRepodata.AddPackage(name, curPackages[name])
+					delete(ledger.Failures, name)
+				case packageUpToDate:
+					nUpToDate += 1
+					successRepodata.AddPackage(name, curPackages[name])
+					delete(ledger.Failures, name)
+				}
 
-			pkgFilename := filepath.Join(s.RelativeLocation, name)
-			logger.Printf("[INFO] Updating package: %s", pkgFilename)
-			newTarFile, err := src.GetFileReadCloser(pkgFilename)
-			if err != nil {
-				log.Printf("[ERROR] Could not fetch package %s: %s", pkgFilename, err.Error())
-				continue
-			}
-			tarFileDir := filepath.Join(workDir, name)
-			id := filepath.Join(svrName, s.RelativeLocation, name)
-			metadataSha256, err := extractPackageAndGenerateMetadataDocument(newTarFile, tarFileDir, id, checksumType, newChecksum, pkg, s.ExtraData)
-			newTarFile.Close()
-			if err != nil {
-				log.Printf("[ERROR] Could not fetch and extract metadata for %s: %s", name, err.Error())
-				continue
-			}
-			curKafkadocs.Docs[id] = domain.KafkadocEntry{
-				Path:   filepath.Join(name, "metadata.json"),
-				Sha256: metadataSha256,
+				processed[name] = true
+				if nSinceCheckpoint > 0 && ((cfg.CheckpointPackages > 0 && nSinceCheckpoint >= cfg.CheckpointPackages) ||
+					(cfg.CheckpointSeconds > 0 && time.Since(lastCheckpoint) >= time.Duration(cfg.CheckpointSeconds)*time.Second)) {
+					if err := writeCheckpoint(histRepodataFilename, curKafkadocsFilename, failureLedgerFilename, histPackages, processed, successRepodata, curKafkadocs, ledger); err != nil {
+						logger.Printf("[ERROR] Could not checkpoint progress of %s: %s", s.RelativeLocation, err.Error())
+					} else {
+						logger.Printf("[INFO] Checkpointed progress of %s: %d of %d packages processed", s.RelativeLocation, len(processed), len(names))
+					}
+					nSinceCheckpoint = 0
+					lastCheckpoint = time.Now()
+				}
+				mu.Unlock()
 			}
-			logger.Printf("[INFO] Successfully Updated package: %s", pkgFilename)
-			nUpdated += 1
-			nFailed -= 1
-			successRepodata.Packages[name] = pkg
-		} else {
-			logger.Printf("[INFO] Package %s is already up-to-date", filepath.Join(s.RelativeLocation, name))
-			nUpToDate += 1
-			successRepodata.Packages[name] = pkg
-		}
+		}()
+	}
+	for _, name := range names {
+		work <- name
 	}
+	close(work)
+	wg.Wait()
 
 	// Delete files in: historic - current
-	for name := range histRepodata.Packages {
-		if _, ok := curRepodata.Packages[name]; !ok {
-			pkgLocationDir := filepath.Join(workDir, s.RelativeLocation, name)
+	for name := range histPackages {
+		if _, ok := curPackages[name]; !ok {
+			pkgLocationDir := filepath.Join(workDir, name)
 			if _, err = os.Stat(pkgLocationDir); !os.IsNotExist(err) {
 				os.RemoveAll(pkgLocationDir)
 			}
@@ -140,6 +265,16 @@ func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.C
 		}
 	}
 
+	// As in writeCheckpoint, the kafkadocs go first: whatever the history says is indexed or deleted must have
+	// its metadata document or tombstone in them, should the run stop in between
+	if err = json.NewEncoder(kafkadocsTempFile).Encode(curKafkadocs); err != nil {
+		return logger.ErrorPrintf("could not write to current kafkadocs file: %s", err.Error())
+	}
+
+	if err = kafkadocsTempFile.CloseAtomicallyReplace(); err != nil {
+		return logger.ErrorPrintf("could not update current kafkadocs file: %s", err.Error())
+	}
+
 	if err = json.NewEncoder(repodataTempFile).Encode(successRepodata); err != nil {
 		return logger.ErrorPrintf("could not write success data to new history file: %s", err.Error())
 	}
@@ -148,20 +283,226 @@ func IndexSubdir(s domain.Subdir, prefixDir string, svrName string, src domain.C
 		return logger.ErrorPrintf("could not update histrorical repodata file: %s", err.Error())
 	}
 
-	logger.Printf("[INFO] Summary for %s: (Old -> New) = (%d -> %d), Updated = %d, Deleted = %d, Failed = %d, Skipped = %d, Up-to-date = %d",
-		s.RelativeLocation, nOldPackages, nCurPackages, nUpdated, nDeleted, nFailed, nSkipped, nUpToDate)
+	logger.Printf("[INFO] Summary for %s: (Old -> New) = (%d -> %d), Updated = %d, Deleted = %d, Failed = %d, Skipped = %d, Up-to-date = %d, Removed = %d, Revoked = %d, Deferred = %d, Poisoned = %d",
+		s.RelativeLocation, nOldPackages, nCurPackages, nUpdated, nDeleted, nFailed, nSkipped, nUpToDate, nRemoved, nRevoked, nDeferred, nPoisoned)
 
-	if err = json.NewEncoder(kafkadocsTempFile).Encode(curKafkadocs); err != nil {
-		return logger.ErrorPrintf("could not write to current kafkadocs file: %s", err.Error())
+	if err = writeFailureLedger(failureLedgerFilename, ledger); err != nil {
+		return err
 	}
 
-	if err = kafkadocsTempFile.CloseAtomicallyReplace(); err != nil {
-		return logger.ErrorPrintf("could not update current kafkadocs file: %s", err.Error())
+	// The executables are only derived from the metadata documents, and do not fail the subdir. They are brought
+	// up to date by the next run that is not skipped, whatever this one leaves them in.
+	docSums := make(map[string]string)
+	for name := range successRepodata.AllPackages() {
+		docSums[name] = curKafkadocs.Docs[filepath.Join(svrName, s.RelativeLocation, name)].Sha256
+	}
+	executablesUpdated := true
+	if err = updateExecutablesFile(workDir, docSums); err != nil {
+		logger.Printf("[ERROR] Could not update executables of %s: %s", s.RelativeLocation, err.Error())
+		executablesUpdated = false
+	}
+
+	// Packages whose retries are deferred still need another run, unlike poisoned ones
+	if fingerprint != "" && nFailed == 0 && nSkipped == 0 && nDeferred == 0 && executablesUpdated {
+		if err = renameio.WriteFile(fingerprintFilename, []byte(fingerprint+"\n"), 0644); err != nil {
+			logger.Printf("[ERROR] Could not record fingerprint of %s: %s", s.RelativeLocation, err.Error())
+		}
 	}
 
 	return nil
 }
 
+// writeCheckpoint atomically persists the progress of indexing a subdir: first its kafkadocs, and then a history
+// that is histPackages with the packages processed so far replaced by their entries in successRepodata, or
+// dropped if they are not in it i.e. they failed. Writing them in this order means that whatever the history says
+// is indexed has its metadata document in the kafkadocs. The failure ledger is persisted along with them, for the
+// backoff of the packages that failed so far to survive the run being cut short.
+func writeCheckpoint(histRepodataFilename string,
+	curKafkadocsFilename string,
+	failureLedgerFilename string,
+	histPackages map[string]domain.CondaPackage,
+	processed map[string]bool,
+	successRepodata *domain.CondaRepodata,
+	curKafkadocs *domain.Kafkadocs,
+	ledger *domain.FailureLedger) error {
+	checkpointRepodata := domain.NewCondaRepodata()
+	for name, pkg := range histPackages {
+		if !processed[name] {
+			checkpointRepodata.AddPackage(name, pkg)
+		}
+	}
+	for name, pkg := range successRepodata.AllPackages() {
+		checkpointRepodata.AddPackage(name, pkg)
+	}
+
+	for _, f := range []struct {
+		filename string
+		data     interface{}
+	}{
+		{curKafkadocsFilename, curKafkadocs},
+		{histRepodataFilename, checkpointRepodata},
+	} {
+		tmp, err := renameio.TempFile("", f.filename)
+		if err != nil {
+			return err
+		}
+		if err = json.NewEncoder(tmp).Encode(f.data); err != nil {
+			//nolint:errcheck
+			tmp.Cleanup()
+			return err
+		}
+		if err = tmp.CloseAtomicallyReplace(); err != nil {
+			//nolint:errcheck
+			tmp.Cleanup()
+			return err
+		}
+	}
+
+	return writeFailureLedger(failureLedgerFilename, ledger)
+}
+
+// Outcomes of indexing a single package
+type packageOutcome int
+
+const (
+	packageUpToDate packageOutcome = iota
+	packageUpdated
+	packageFailed
+	packageSkipped
+	packageDeferred
+	packagePoisoned
+)
+
+// packageResult is the outcome of indexing a single package, along with the kafkadoc entry of
+// its metadata document if it was updated, or the error if it failed.
+type packageResult struct {
+	outcome  packageOutcome
+	id       string
+	kafkadoc domain.KafkadocEntry
+	checksum string
+	err      error
+}
+
+// indexPackage indexes package name of subdir s, whose current repodata entry is pkg and historic one (if any) is
+// histPkg: unless it is up-to-date, its files are extracted into its directory in workDir and its metadata
+// document generated. Errors are logged, and reflected in the outcome of the result. failure is the earlier
+// failure of the package, if any, which defers the next attempt or rules it out.
+func indexPackage(s domain.Subdir,
+	workDir string,
+	svrName string,
+	src domain.CondaChannelFileSource,
+	cfg domain.IndexerConfig,
+	name string,
+	histPkg domain.CondaPackage,
+	pkg domain.CondaPackage,
+	failure *domain.PackageFailure) packageResult {
+	logger := helpers.GetAppLogger()
+
+	id := filepath.Join(svrName, s.RelativeLocation, name)
+	settings := extractionSettingsOf(s, cfg)
+
+	updateRequired, checksumType, newChecksum, err := updateRequiredDueToChecksumDiff(histPkg, pkg)
+	if err != nil {
+		logger.Printf("[ERROR] Skipping package %s: %s", name, err.Error())
+		return packageResult{outcome: packageSkipped, id: id}
+	}
+
+	// Files extracted under other settings, which the new ones may not extract, must not linger in the directory
+	// of the package and end up in its metadata document
+	regenerateRequired := !reflect.DeepEqual(histPkg, pkg)
+	clearRequired := false
+	if !updateRequired {
+		differ, formatDiffers := extractionSettingsDiffer(filepath.Join(workDir, name), settings)
+		if differ {
+			logger.Printf("[INFO] What to extract changed since package %s was extracted; re-extracting it", filepath.Join(s.RelativeLocation, name))
+			updateRequired = true
+			clearRequired = true
+		} else if formatDiffers {
+			logger.Printf("[INFO] Metadata document of package %s is of another format; regenerating it", filepath.Join(s.RelativeLocation, name))
+			regenerateRequired = true
+		}
+	}
+
+	if !updateRequired && regenerateRequired {
+		// The package itself is unchanged but its repodata entry (patched, for example) or the format of its
+		// metadata document is not, so the document only needs to be regenerated from the files extracted
+		// from it earlier.
+		metadataSha256, err := generateMetadataDocument(filepath.Join(workDir, name), id, pkg, s.ExtraData, settings)
+		if err == nil {
+			err = writeExtractionSettings(filepath.Join(workDir, name), settings)
+		}
+		if err == nil {
+			logger.Printf("[INFO] Successfully Updated repodata of package: %s", filepath.Join(s.RelativeLocation, name))
+			return packageResult{
+				outcome: packageUpdated,
+				id:      id,
+				kafkadoc: domain.KafkadocEntry{
+					Path:   filepath.Join(name, "metadata.json"),
+					Sha256: metadataSha256,
+				},
+			}
+		}
+		logger.Printf("[INFO] Could not regenerate metadata of package %s; re-extracting it", filepath.Join(s.RelativeLocation, name))
+		updateRequired = true
+	}
+
+	if !updateRequired {
+		logger.Printf("[INFO] Package %s is already up-to-date", filepath.Join(s.RelativeLocation, name))
+		return packageResult{outcome: packageUpToDate, id: id}
+	}
+
+	pkgFilename := filepath.Join(s.RelativeLocation, name)
+	if failure != nil && failure.Checksum == newChecksum {
+		if failure.Poisoned {
+			logger.Printf("[INFO] Not retrying package %s which failed %d times", pkgFilename, failure.Attempts)
+			return packageResult{outcome: packagePoisoned, id: id, checksum: newChecksum}
+		}
+		if time.Now().Before(failure.NextRetry) {
+			logger.Printf("[INFO] Deferring retry of package %s until %s", pkgFilename, failure.NextRetry.Format(time.RFC3339))
+			return packageResult{outcome: packageDeferred, id: id, checksum: newChecksum}
+		}
+	}
+
+	logger.Printf("[INFO] Updating package: %s", pkgFilename)
+	tarFileDir := filepath.Join(workDir, name)
+	if clearRequired {
+		if err = os.RemoveAll(tarFileDir); err != nil {
+			logger.Printf("[ERROR] Could not clear directory of package %s: %s", pkgFilename, err.Error())
+			return packageResult{outcome: packageFailed, id: id, checksum: newChecksum, err: err}
+		}
+	}
+	if err = fetchAndExtractPackage(src, pkgFilename, tarFileDir, checksumType, newChecksum, settings, cfg); err != nil {
+		log.Printf("[ERROR] Could not fetch and extract package %s: %s", pkgFilename, err.Error())
+		return packageResult{outcome: packageFailed, id: id, checksum: newChecksum, err: err}
+	}
+	metadataSha256, err := generateMetadataDocument(tarFileDir, id, pkg, s.ExtraData, settings)
+	if err != nil {
+		log.Printf("[ERROR] Could not generate metadata for %s: %s", name, err.Error())
+		return packageResult{outcome: packageFailed, id: id, checksum: newChecksum, err: &packageError{domain.FailureClassMetadata, err}}
+	}
+	logger.Printf("[INFO] Successfully Updated package: %s", pkgFilename)
+
+	return packageResult{
+		outcome: packageUpdated,
+		id:      id,
+		kafkadoc: domain.KafkadocEntry{
+			Path:   filepath.Join(name, "metadata.json"),
+			Sha256: metadataSha256,
+		},
+	}
+}
+
+// isPackageRevoked tells if the repodata entry of a package flags it as revoked.
+func isPackageRevoked(pkg domain.CondaPackage) bool {
+	switch revoked := pkg["revoked"].(type) {
+	case bool:
+		return revoked
+	case string:
+		return strings.ToLower(revoked) == "true"
+	}
+	return false
+}
+
 // updateRequiredDueToChecksumDiff compares the checksums specified in newPkg to that in oldPkg to determine
 // if an update is required. It also returns the type-of-checksum used (sha256 or md5), the checksum, and error, if any.
 // If newPkg does not specify a sha256 or md5 checksum (sha256 is first preference), an error is returned.
@@ -206,29 +547,126 @@ func updateRequiredDueToChecksumDiff(oldPkg, newPkg domain.CondaPackage) (bool,
 	return true, "sha256", newpkgSha, nil // Older one doesn't have sha256sum, newer one does. Got to update!
 }
 
-func extractPackageAndGenerateMetadataDocument(r io.Reader,
+// fetchAndExtractPackage fetches the package at pkgFilename from src, extracts it into prefixDir as settings
+// tell, recording them, and verifies the checksum of the package against expectedChecksum. In deep scan,
+// exported symbols, PyPI names and build provides modes, the files of the package are scanned as it is read,
+// and what is found is kept in prefixDir as well. For .conda packages, if cfg enables range extraction and src can serve byte ranges, only
+// the info section of the package is fetched (unless files are scanned, which needs all of it); its checksum
+// is then either verified against the one published by src or, in trust mode, not verified at all.
+func fetchAndExtractPackage(src domain.CondaChannelFileSource,
+	pkgFilename string,
 	prefixDir string,
-	id string,
 	checksumType string,
 	expectedChecksum string,
-	repodata domain.CondaPackage,
-	extraData map[string]interface{}) (string, error) {
+	settings extractionSettings,
+	cfg domain.IndexerConfig) error {
 	logger := helpers.GetAppLogger()
-	allowedFiles := []string{
-		"info/about.json",
-		"info/index.json",
-		"info/files",
-		"info/paths.json",
+
+	rangeSrc, srcSupportsRanges := src.(domain.CondaChannelRangeFileSource)
+	rangeMode := cfg.CondaRangeExtraction
+	if domain.IsCondaV2Package(pkgFilename) && srcSupportsRanges && !settings.scansFiles() &&
+		(rangeMode == domain.RangeExtractionTrust || rangeMode == domain.RangeExtractionPublished) {
+		err := extractCondaPackageInfoByRange(rangeSrc, pkgFilename, prefixDir, checksumType, expectedChecksum, settings.InfoFiles, rangeMode)
+		if err == nil {
+			return writeScansAndSettings(prefixDir, nil, settings)
+		}
+		if err != domain.ErrRangesNotSupported {
+			return err
+		}
+		logger.Printf("[DEBUG] Byte ranges not supported for %s; fetching it whole", pkgFilename)
 	}
-	actualChecksum, err := helpers.TarBz2ExtractFilesAndGetChecksum(r, prefixDir, allowedFiles, checksumType)
+
+	pkgFile, err := src.GetFileReadCloser(pkgFilename)
 	if err != nil {
-		return "", logger.ErrorPrintf("could not extract package: %s", err.Error())
+		return &packageError{domain.FailureClassFetch, logger.ErrorPrintf("could not fetch package: %s", err.Error())}
+	}
+	defer pkgFile.Close()
+
+	var scanner *deepScanner
+	var visit helpers.TarEntryVisitor
+	if settings.scansFiles() {
+		scanner = newDeepScanner(cfg.DeepScanMaxFileBytes, settings)
+		visit = scanner.visit
+	}
+
+	actualChecksum, err := helpers.PackageExtractFilesAndGetChecksum(pkgFilename, pkgFile, prefixDir, settings.globs(), visit, checksumType)
+	if err != nil {
+		return logger.ErrorPrintf("could not extract package: %s", err.Error())
 	}
 	if expectedChecksum != "" && actualChecksum != expectedChecksum {
-		return "", logger.ErrorPrintf("Checksum mismatch: %s: actual %s vs expected %s",
-			checksumType, actualChecksum, expectedChecksum)
+		return &packageError{domain.FailureClassChecksum, logger.ErrorPrintf("Checksum mismatch: %s: actual %s vs expected %s",
+			checksumType, actualChecksum, expectedChecksum)}
+	}
+
+	return writeScansAndSettings(prefixDir, scanner, settings)
+}
+
+// writeScansAndSettings writes what scanner found, if anything, and the settings a package was extracted with
+// into prefixDir.
+func writeScansAndSettings(prefixDir string, scanner *deepScanner, settings extractionSettings) error {
+	if err := writeDeepScan(prefixDir, scanner); err != nil {
+		return err
+	}
+	if err := writeSymbolsFile(prefixDir, scanner); err != nil {
+		return err
+	}
+	return writeExtractionSettings(prefixDir, settings)
+}
+
+// extractCondaPackageInfoByRange extracts the infoFiles of a .conda package into prefixDir by reading
+// only the zip central directory and the info-*.tar.zst member of the package from src.
+// domain.ErrRangesNotSupported is returned as is if src cannot serve byte ranges for the package.
+func extractCondaPackageInfoByRange(src domain.CondaChannelRangeFileSource,
+	pkgFilename string,
+	prefixDir string,
+	checksumType string,
+	expectedChecksum string,
+	infoFiles []domain.InfoFileSpec,
+	rangeMode string) error {
+	logger := helpers.GetAppLogger()
+
+	if rangeMode == domain.RangeExtractionPublished {
+		publishedChecksum, err := src.GetFilePublishedChecksum(pkgFilename, checksumType)
+		if err != nil {
+			return &packageError{domain.FailureClassFetch, logger.ErrorPrintf("could not get published %s checksum: %s", checksumType, err.Error())}
+		}
+		if expectedChecksum != "" && publishedChecksum != expectedChecksum {
+			return &packageError{domain.FailureClassChecksum, logger.ErrorPrintf("Checksum mismatch: %s: published %s vs expected %s",
+				checksumType, publishedChecksum, expectedChecksum)}
+		}
 	}
 
+	ra, size, err := src.GetFileReaderAt(pkgFilename)
+	if err == domain.ErrRangesNotSupported {
+		return err
+	}
+	if err != nil {
+		return &packageError{domain.FailureClassFetch, logger.ErrorPrintf("could not open package for reading byte ranges: %s", err.Error())}
+	}
+	defer ra.Close()
+
+	if err = os.MkdirAll(prefixDir, 0755); err != nil {
+		return logger.ErrorPrintf("could not create dir %s: %s", prefixDir, err.Error())
+	}
+
+	if err = helpers.CondaExtractInfoFiles(ra, size, prefixDir, infoFileGlobs(infoFiles)); err != nil {
+		return logger.ErrorPrintf("could not extract package info: %s", err.Error())
+	}
+
+	return nil
+}
+
+// generateMetadataDocument generates the metadata.json document for a package whose info files have been
+// extracted into prefixDir, and returns the sha256sum of the document. The document combines the repodata
+// entry of the package, extraData, the contents of the info files and whatever else was extracted from the
+// package, as settings tell.
+func generateMetadataDocument(prefixDir string,
+	id string,
+	repodata domain.CondaPackage,
+	extraData map[string]interface{},
+	settings extractionSettings) (string, error) {
+	logger := helpers.GetAppLogger()
+
 	// Generate MetadataDocument
 	res := make(map[string]interface{})
 	for k, v := range repodata {
@@ -241,50 +679,36 @@ func extractPackageAndGenerateMetadataDocument(r io.Reader,
 	}
 	res["id"] = id
 
-	pathsJsonFilename := filepath.Join(prefixDir, "info/paths.json")
-	pathsJson, pathsErr := readJsonFromFile(pathsJsonFilename)
-
-	filesFilename := filepath.Join(prefixDir, "info/files")
-	filesJson, filesErr := readLinesIntoJsonArray(filesFilename, "files")
+	addInfoFilesToDocument(prefixDir, settings.InfoFiles, res)
+	if err := addDeepScanToDocument(prefixDir, res); err != nil {
+		return "", logger.ErrorPrintf("could not read deep scan of package: %s", err.Error())
+	}
 
-	if filesErr != nil {
-		if pathsErr == nil {
-			if pathsData, ok := pathsJson["paths"]; ok {
-				if pathsArr, ok := pathsData.([]interface{}); ok {
-					filesJson = make(map[string]interface{})
-					filesJson["files"] = arrayOfObjectsToArrayOfStrings(pathsArr, "_path")
-					filesErr = nil
-				}
-			}
-		} else {
+	// Packages without info/files list their files in info/paths.json only
+	if _, ok := res["files"]; !ok && hasInfoFileKey(settings.InfoFiles, "files") {
+		if pathsArr, ok := res["paths"].([]interface{}); ok {
+			res["files"] = arrayOfObjectsToArrayOfStrings(pathsArr, "_path")
+		} else if _, ok := res["paths"]; !ok {
 			return "", logger.ErrorPrintf("could not parse both of info/files and info/paths.json")
 		}
 	}
 
-	aboutJsonFilename := filepath.Join(prefixDir, "info/about.json")
-	aboutJson, aboutErr := readJsonFromFile(aboutJsonFilename)
+	if modules := pythonModules(documentFiles(res)); len(modules) > 0 {
+		res["python_modules"] = modules
+	}
+	if settings.BuildProvides {
+		res["provides"] = buildProvides(prefixDir, documentFiles(res))
+	}
 
 	// Convert root_pkgs to an array of strings
-	if aboutJsonRootPkgs, ok := aboutJson["root_pkgs"]; ok {
-		if aboutJsonRootPkgsArr, ok := aboutJsonRootPkgs.([]interface{}); ok {
+	if aboutJson, ok := res["about"].(map[string]interface{}); ok {
+		if aboutJsonRootPkgsArr, ok := aboutJson["root_pkgs"].([]interface{}); ok {
 			aboutJson["root_pkgs"] = arrayOfObjectsToArrayOfStrings(aboutJsonRootPkgsArr, "dist_name")
 		}
 	}
 
-	if pathsErr == nil {
-		res["paths"] = pathsJson["paths"]
-	}
-
-	if filesErr == nil {
-		res["files"] = filesJson["files"]
-	}
-
-	if aboutErr == nil {
-		res["about"] = aboutJson
-	}
-
 	metadataFilename := filepath.Join(prefixDir, "metadata.json")
-	metadataFile, err := os.OpenFile(metadataFilename, os.O_WRONLY|os.O_CREATE, 0755)
+	metadataFile, err := os.OpenFile(metadataFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return "", logger.ErrorPrintf("could not open/create metadata.json file for writing: %s", err.Error())
 	}
@@ -300,6 +724,16 @@ func extractPackageAndGenerateMetadataDocument(r io.Reader,
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
+// hasInfoFileKey tells if any of infoFiles goes into key of the metadata document.
+func hasInfoFileKey(infoFiles []domain.InfoFileSpec, key string) bool {
+	for _, spec := range infoFiles {
+		if spec.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
 // arrayOfObjectsToArrayOfStrings walks through an array of objects and
 // tries extracting field as a string in each element. If that object cannot be parsed,
 // it is ignored. The order is preserved. If field is not present in any of the elements,
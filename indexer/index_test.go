@@ -0,0 +1,498 @@
+package indexer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeCondaChannel publishes .conda packages in the subdir "ch/linux-64" of a directory, along with the
+// repodata.json listing them.
+type fakeCondaChannel struct {
+	t        *testing.T
+	dir      string
+	packages map[string]domain.CondaPackage
+}
+
+func newFakeCondaChannel(t *testing.T) *fakeCondaChannel {
+	c := &fakeCondaChannel{t: t, dir: t.TempDir(), packages: make(map[string]domain.CondaPackage)}
+	if err := os.MkdirAll(filepath.Join(c.dir, "ch", "linux-64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.writeRepodata()
+	return c
+}
+
+// tarZst returns a zstd-compressed tarball of files, by path.
+func tarZst(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(enc)
+	for _, name := range names {
+		if err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// condaArchive returns a .conda archive of files, by path: those under info/ go into its info-*.tar.zst member,
+// which comes first, and the others into its pkg-*.tar.zst member.
+func condaArchive(t *testing.T, stem string, files map[string]string) []byte {
+	info, pkg := make(map[string]string), make(map[string]string)
+	for name, data := range files {
+		if strings.HasPrefix(name, "info/") {
+			info[name] = data
+		} else {
+			pkg[name] = data
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{"metadata.json", nil},
+		{"info-" + stem + ".tar.zst", info},
+		{"pkg-" + stem + ".tar.zst", pkg},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(`{"conda_pkg_format_version": 2}`)
+		if m.files != nil {
+			data = tarZst(t, m.files)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// putPackage publishes the package name-version-0.conda of files, by path, along with its info/index.json and
+// info/files, and returns its filename.
+func (c *fakeCondaChannel) putPackage(name string, version string, files map[string]string) string {
+	stem := name + "-" + version + "-0"
+	all := map[string]string{"info/index.json": `{"name": "` + name + `", "version": "` + version + `"}`}
+	var paths []string
+	for p, data := range files {
+		all[p] = data
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	all["info/files"] = strings.Join(paths, "\n") + "\n"
+
+	data := condaArchive(c.t, stem, all)
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "ch", "linux-64", stem+".conda"), data, 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	c.packages[stem+".conda"] = domain.CondaPackage{"name": name, "version": version, "build": "0", "sha256": hex.EncodeToString(sum[:])}
+	c.writeRepodata()
+	return stem + ".conda"
+}
+
+// removePackage unpublishes the package filename.
+func (c *fakeCondaChannel) removePackage(filename string) {
+	if err := os.Remove(filepath.Join(c.dir, "ch", "linux-64", filename)); err != nil {
+		c.t.Fatal(err)
+	}
+	delete(c.packages, filename)
+	c.writeRepodata()
+}
+
+func (c *fakeCondaChannel) writeRepodata() {
+	data, err := json.Marshal(map[string]interface{}{"packages": map[string]interface{}{}, "packages.conda": c.packages})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(c.dir, "ch", "linux-64", "repodata.json"), data, 0644); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *fakeCondaChannel) source() *helpers.LocalFileSource {
+	src := &helpers.LocalFileSource{SourceDir: c.dir, TempDir: c.t.TempDir()}
+	if err := src.Init(); err != nil {
+		c.t.Fatal(err)
+	}
+	return src
+}
+
+// testIndexerConfig is the indexer config to index the subdirs of a fakeCondaChannel with.
+func testIndexerConfig() domain.IndexerConfig {
+	return domain.IndexerConfig{
+		DeepScanMaxFileBytes: 1 << 20,
+		CondaRangeExtraction: domain.RangeExtractionOff,
+		RevokedPackages:      domain.RevokedPackagesFlag,
+	}
+}
+
+func TestWriteCheckpointPersistsFailureLedger(t *testing.T) {
+	dir := t.TempDir()
+	histRepodataFilename := filepath.Join(dir, "repodata.json")
+	curKafkadocsFilename := filepath.Join(dir, "kafkadocs.json")
+	failureLedgerFilename := filepath.Join(dir, "failures.json")
+
+	histPackages := map[string]domain.CondaPackage{
+		"foo-1.0-0.tar.bz2": {"name": "foo"},
+		"bar-1.0-0.tar.bz2": {"name": "bar"},
+	}
+	successRepodata := domain.NewCondaRepodata()
+	successRepodata.AddPackage("foo-1.0-0.tar.bz2", histPackages["foo-1.0-0.tar.bz2"])
+	ledger := &domain.FailureLedger{Failures: make(map[string]domain.PackageFailure)}
+	recordPackageFailure(ledger, "bar-1.0-0.tar.bz2", "abc", errors.New("truncated archive"), time.Now(), domain.IndexerConfig{})
+
+	processed := map[string]bool{"foo-1.0-0.tar.bz2": true, "bar-1.0-0.tar.bz2": true}
+	if err := writeCheckpoint(histRepodataFilename, curKafkadocsFilename, failureLedgerFilename,
+		histPackages, processed, successRepodata, &domain.Kafkadocs{Docs: make(map[string]domain.KafkadocEntry)}, ledger); err != nil {
+		t.Fatalf("writeCheckpoint: %s", err)
+	}
+
+	got, err := readInFailureLedger(failureLedgerFilename)
+	if err != nil {
+		t.Fatalf("readInFailureLedger: %s", err)
+	}
+	failure, ok := got.Failures["bar-1.0-0.tar.bz2"]
+	if !ok || len(got.Failures) != 1 {
+		t.Fatalf("got failures %v, want bar-1.0-0.tar.bz2 only", got.Failures)
+	}
+	if failure.Checksum != "abc" || failure.Attempts != 1 || failure.Error != "truncated archive" {
+		t.Errorf("got failure %+v", failure)
+	}
+}
+
+func TestIndexSubdirClearsPackageDirWhenReextracting(t *testing.T) {
+	c := newFakeCondaChannel(t)
+	name := c.putPackage("foo", "1.0", map[string]string{"bin/foo": "#!/bin/sh\n", "info/licenses/LICENSE": "MIT"})
+	s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+	workDir := t.TempDir()
+	pkgDir := filepath.Join(workDir, "ch", "linux-64", name)
+
+	cfg := testIndexerConfig()
+	cfg.InfoFiles = []domain.InfoFileSpec{
+		{Path: "info/index.json"},
+		{Path: "info/files", Key: "files", Format: domain.InfoFileFormatLines},
+		{Path: "info/licenses/**", Key: "licenses"},
+	}
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkgDir, "info", "licenses", "LICENSE")); err != nil {
+		t.Fatalf("license not extracted: %s", err)
+	}
+
+	// The licenses are no longer extracted, and the one extracted before is not left behind
+	cfg.InfoFiles = cfg.InfoFiles[:2]
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir with other info files: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkgDir, "info", "licenses", "LICENSE")); !os.IsNotExist(err) {
+		t.Errorf("got license left behind in the package directory (%v)", err)
+	}
+	doc, err := ReadMetadataDocument(pkgDir)
+	if err != nil {
+		t.Fatalf("ReadMetadataDocument: %s", err)
+	}
+	if _, ok := doc["licenses"]; ok || documentString(doc, "name") != "foo" {
+		t.Errorf("got metadata document %v", doc)
+	}
+}
+
+func TestIndexSubdirRegeneratesDocumentsOfAnotherFormat(t *testing.T) {
+	c := newFakeCondaChannel(t)
+	name := c.putPackage("foo", "1.0", map[string]string{"lib/python3.11/site-packages/foo/__init__.py": ""})
+	s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+	workDir := t.TempDir()
+	subdirDir := filepath.Join(workDir, "ch", "linux-64")
+	pkgDir := filepath.Join(subdirDir, name)
+	cfg := testIndexerConfig()
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir: %s", err)
+	}
+
+	// The document was generated by an older format, without python_modules. The package itself is gone from
+	// the channel, so that it cannot be extracted again, only its document regenerated from what was extracted.
+	settings := extractionSettingsOf(s, cfg)
+	settings.DocumentFormat = metadataDocumentFormat - 1
+	if err := writeExtractionSettings(pkgDir, settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "metadata.json"), []byte(`{"name": "foo"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(c.dir, "ch", "linux-64", name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir of another format: %s", err)
+	}
+
+	doc, err := ReadMetadataDocument(pkgDir)
+	if err != nil {
+		t.Fatalf("ReadMetadataDocument: %s", err)
+	}
+	if modules, _ := doc["python_modules"].([]interface{}); len(modules) != 1 || modules[0] != "foo" {
+		t.Errorf("got python_modules %v, want [foo]", doc["python_modules"])
+	}
+	if differ, formatDiffers := extractionSettingsDiffer(pkgDir, extractionSettingsOf(s, cfg)); differ || formatDiffers {
+		t.Errorf("got extraction settings that differ (%t) or of another format (%t)", differ, formatDiffers)
+	}
+
+	kafkadocs, err := readInKafkadocsFile(filepath.Join(subdirDir, "kafkadocs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(pkgDir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if got := kafkadocs.Docs[filepath.Join("svr", "ch", "linux-64", name)].Sha256; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("got kafkadoc sum %s of the regenerated document, want %s", got, hex.EncodeToString(sum[:]))
+	}
+}
+
+// packageServer serves a single package at /ch/linux-64/foo-1.0-0.conda, by range or only whole, with the
+// checksum it publishes, if any, in the X-Checksum-Sha256 header.
+type packageServer struct {
+	data     []byte
+	ranges   bool
+	checksum string
+
+	wholeGets int32
+	rangeGets int32
+}
+
+func (p *packageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ch/linux-64/foo-1.0-0.conda" {
+		http.NotFound(w, r)
+		return
+	}
+	if p.checksum != "" {
+		w.Header().Set("X-Checksum-Sha256", p.checksum)
+	}
+	if r.Method == http.MethodGet {
+		if r.Header.Get("Range") != "" && p.ranges {
+			atomic.AddInt32(&p.rangeGets, 1)
+		} else {
+			atomic.AddInt32(&p.wholeGets, 1)
+		}
+	}
+	if p.ranges {
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(p.data))
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Write(p.data)
+	}
+}
+
+func TestFetchAndExtractPackageByRange(t *testing.T) {
+	pkg := condaArchive(t, "foo-1.0-0", map[string]string{
+		"info/index.json": `{"name": "foo"}`,
+		"info/files":      "bin/foo\n",
+		"bin/foo":         "#!/bin/sh\n",
+	})
+	sum := sha256.Sum256(pkg)
+	checksum := hex.EncodeToString(sum[:])
+	otherChecksum := strings.Repeat("0", len(checksum))
+
+	for _, tc := range []struct {
+		desc              string
+		mode              string
+		ranges            bool
+		published         string
+		expected          string
+		class             string // of the error, if any
+		byRange, wholeGet bool
+	}{
+		{"trusted", domain.RangeExtractionTrust, true, "", checksum, "", true, false},
+		{"trusted without a checksum to check", domain.RangeExtractionTrust, true, "", "", "", true, false},
+		{"published", domain.RangeExtractionPublished, true, checksum, checksum, "", true, false},
+		{"published otherwise", domain.RangeExtractionPublished, true, otherChecksum, checksum, domain.FailureClassChecksum, false, false},
+		{"off", domain.RangeExtractionOff, true, "", checksum, "", false, true},
+		{"ranges refused", domain.RangeExtractionTrust, false, "", checksum, "", false, true},
+		{"ranges refused, published", domain.RangeExtractionPublished, false, checksum, checksum, "", false, true},
+		// Packages fetched whole are checked even if they would have been trusted
+		{"ranges refused, bad package", domain.RangeExtractionTrust, false, "", otherChecksum, domain.FailureClassChecksum, false, true},
+	} {
+		p := &packageServer{data: pkg, ranges: tc.ranges, checksum: tc.published}
+		svr := httptest.NewServer(p)
+		src := &helpers.HttpFileSource{BaseUrl: svr.URL + "/"}
+		if err := src.Init(); err != nil {
+			t.Fatal(err)
+		}
+		cfg := testIndexerConfig()
+		cfg.CondaRangeExtraction = tc.mode
+		settings := extractionSettingsOf(domain.Subdir{}, cfg)
+		prefixDir := filepath.Join(t.TempDir(), "foo-1.0-0.conda")
+
+		err := fetchAndExtractPackage(src, "ch/linux-64/foo-1.0-0.conda", prefixDir, "sha256", tc.expected, settings, cfg)
+		svr.Close()
+		if tc.class != "" {
+			if err == nil || failureClassOf(err) != tc.class {
+				t.Errorf("%s: got error %v, want one of class %s", tc.desc, err, tc.class)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+		} else if _, err = os.Stat(filepath.Join(prefixDir, "info", "index.json")); err != nil {
+			t.Errorf("%s: info/index.json was not extracted: %s", tc.desc, err)
+		}
+
+		if byRange, wholeGet := p.rangeGets > 0, p.wholeGets > 0; byRange != tc.byRange || wholeGet != tc.wholeGet {
+			t.Errorf("%s: got %d range and %d whole requests, want by range %t and whole %t", tc.desc, p.rangeGets, p.wholeGets, tc.byRange, tc.wholeGet)
+		}
+	}
+}
+
+// readSubdirState reads the history, the kafkadocs and the failure ledger of the subdir "ch/linux-64" in workDir.
+func readSubdirState(t *testing.T, workDir string) (map[string]domain.CondaPackage, map[string]domain.KafkadocEntry, map[string]domain.PackageFailure) {
+	subdirDir := filepath.Join(workDir, "ch", "linux-64")
+	hist, err := readInRepodataFile(filepath.Join(subdirDir, "repodata.json.history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kafkadocs, err := readInKafkadocsFile(filepath.Join(subdirDir, "kafkadocs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := readInFailureLedger(filepath.Join(subdirDir, "failures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hist.AllPackages(), kafkadocs.Docs, ledger.Failures
+}
+
+// Run under -race, this also checks that the workers only share what they update under the lock.
+func TestIndexSubdirWithPackageWorkers(t *testing.T) {
+	c := newFakeCondaChannel(t)
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("pkg%02d", i)
+		names = append(names, c.putPackage(name, "1.0", map[string]string{"bin/" + name: "#!/bin/sh\n"}))
+	}
+	s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+	workDir := t.TempDir()
+	subdirDir := filepath.Join(workDir, "ch", "linux-64")
+	cfg := testIndexerConfig()
+	cfg.PackageWorkers = 4
+	cfg.CheckpointPackages = 3
+
+	// The kafkadocs of indexed packages are the sums of their metadata documents
+	checkIndexed := func(desc string, kafkadocs map[string]domain.KafkadocEntry, name string) {
+		doc, ok := kafkadocs[filepath.Join("svr", "ch", "linux-64", name)]
+		data, err := ioutil.ReadFile(filepath.Join(subdirDir, name, "metadata.json"))
+		if err != nil {
+			t.Errorf("%s: %s", desc, err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		if !ok || doc.Path != filepath.Join(name, "metadata.json") || doc.Sha256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: got kafkadoc %+v (%t) for %s", desc, doc, ok, name)
+		}
+	}
+
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir: %s", err)
+	}
+	hist, kafkadocs, failures := readSubdirState(t, workDir)
+	if len(hist) != 12 || len(kafkadocs) != 12 || len(failures) != 0 {
+		t.Fatalf("first run: got %d packages in the history, %d kafkadocs and %d failures, want 12, 12 and 0",
+			len(hist), len(kafkadocs), len(failures))
+	}
+	for _, name := range names {
+		if !reflect.DeepEqual(hist[name], c.packages[name]) {
+			t.Errorf("first run: got history %v of %s, want %v", hist[name], name, c.packages[name])
+		}
+		checkIndexed("first run", kafkadocs, name)
+	}
+
+	// One package is gone, one is new and another is not a package at all
+	c.removePackage(names[0])
+	added := c.putPackage("pkg12", "1.0", map[string]string{"bin/pkg12": "#!/bin/sh\n"})
+	broken := "broken-1.0-0.conda"
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "ch", "linux-64", broken), []byte("not a zip archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("not a zip archive"))
+	c.packages[broken] = domain.CondaPackage{"name": "broken", "version": "1.0", "build": "0", "sha256": hex.EncodeToString(sum[:])}
+	c.writeRepodata()
+
+	if err := IndexSubdir(s, workDir, "svr", c.source(), cfg); err != nil {
+		t.Fatalf("IndexSubdir after changes: %s", err)
+	}
+	hist, kafkadocs, failures = readSubdirState(t, workDir)
+	if len(hist) != 12 || len(kafkadocs) != 13 || len(failures) != 1 {
+		t.Fatalf("second run: got %d packages in the history, %d kafkadocs and %d failures, want 12, 13 and 1",
+			len(hist), len(kafkadocs), len(failures))
+	}
+	if _, ok := hist[names[0]]; ok {
+		t.Errorf("second run: got removed package %s in the history", names[0])
+	}
+	if doc, ok := kafkadocs[filepath.Join("svr", "ch", "linux-64", names[0])]; !ok || doc.Path != "" || doc.Sha256 != "" {
+		t.Errorf("second run: got kafkadoc %+v (%t) of removed package %s, want a tombstone", doc, ok, names[0])
+	}
+	if _, ok := hist[broken]; ok {
+		t.Errorf("second run: got broken package in the history")
+	}
+	if _, ok := failures[broken]; !ok {
+		t.Errorf("second run: got failures %v, want broken package", failures)
+	}
+	for _, name := range append(names[1:], added) {
+		checkIndexed("second run", kafkadocs, name)
+	}
+
+	executables, err := ReadSubdirExecutables(subdirDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executables) != 12 || executables[0].Command != "pkg01" || executables[11].Command != "pkg12" {
+		t.Errorf("second run: got executables %+v, want pkg01 to pkg12", executables)
+	}
+}
@@ -0,0 +1,204 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// defaultInfoFileSpecs are the info files extracted from packages unless configured otherwise.
+var defaultInfoFileSpecs = []domain.InfoFileSpec{
+	{Path: "info/about.json", Key: "about", Format: domain.InfoFileFormatJson},
+	{Path: "info/index.json"},
+	{Path: "info/files", Key: "files", Format: domain.InfoFileFormatLines},
+	{Path: "info/paths.json", Key: "paths", Format: domain.InfoFileFormatJson, Member: "paths"},
+}
+
+// infoFileSpecsOf returns the info files to extract from the packages of subdir s.
+func infoFileSpecsOf(s domain.Subdir, cfg domain.IndexerConfig) []domain.InfoFileSpec {
+	if len(s.InfoFiles) > 0 {
+		return s.InfoFiles
+	}
+	if len(cfg.InfoFiles) > 0 {
+		return cfg.InfoFiles
+	}
+	return defaultInfoFileSpecs
+}
+
+// infoFileGlobs returns the globs of the files to extract for specs.
+func infoFileGlobs(specs []domain.InfoFileSpec) []string {
+	res := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		res = append(res, spec.Path)
+	}
+	return res
+}
+
+// metadataDocumentFormat is the version of what metadata documents derive from the files extracted from packages,
+// such as their python_modules. It is to be bumped whenever that changes, for existing documents to be regenerated.
+const metadataDocumentFormat = 1
+
+// extractionSettings are what is extracted from a package into its directory, and the format of the metadata
+// document generated from it. They are recorded in it, so that packages are extracted again when they change,
+// and their documents regenerated when only the format does.
+type extractionSettings struct {
+	InfoFiles       []domain.InfoFileSpec `json:"info_files"`
+	DeepScan        bool                  `json:"deep_scan,omitempty"`
+	ExportedSymbols bool                  `json:"exported_symbols,omitempty"`
+	PypiNames       bool                  `json:"pypi_names,omitempty"`
+	BuildProvides   bool                  `json:"build_provides,omitempty"`
+	DocumentFormat  int                   `json:"document_format,omitempty"`
+}
+
+// scansFiles tells if all the files of packages are looked into, not only the info files.
+func (e extractionSettings) scansFiles() bool {
+	return e.DeepScan || e.ExportedSymbols || e.PypiNames || e.BuildProvides
+}
+
+// globs returns the globs of the files to extract.
+func (e extractionSettings) globs() []string {
+	res := infoFileGlobs(e.InfoFiles)
+	if e.BuildProvides {
+		res = append(res, pkgconfigFilesGlob)
+	}
+	return res
+}
+
+const extractionSettingsFilename = "extracted.json"
+
+// extractionSettingsOf returns the settings to extract the packages of subdir s with.
+func extractionSettingsOf(s domain.Subdir, cfg domain.IndexerConfig) extractionSettings {
+	return extractionSettings{
+		InfoFiles:       infoFileSpecsOf(s, cfg),
+		DeepScan:        strings.ToLower(cfg.DeepScan) == "true",
+		ExportedSymbols: strings.ToLower(cfg.ExportedSymbols) == "true",
+		PypiNames:       strings.ToLower(cfg.PypiNames) == "true",
+		BuildProvides:   strings.ToLower(cfg.BuildProvides) == "true",
+		DocumentFormat:  metadataDocumentFormat,
+	}
+}
+
+func writeExtractionSettings(prefixDir string, settings extractionSettings) error {
+	logger := helpers.GetAppLogger()
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return logger.ErrorPrintf("could not serialize extraction settings: %s", err.Error())
+	}
+	filename := filepath.Join(prefixDir, extractionSettingsFilename)
+	if err = renameio.WriteFile(filename, data, 0644); err != nil {
+		return logger.ErrorPrintf("could not write %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// extractionSettingsDiffer tells if the package in prefixDir was extracted with other settings and, if not, whether
+// its metadata document is of another format. Packages extracted before settings were recorded have the default info
+// files extracted and nothing else, and their documents are of no format at all.
+func extractionSettingsDiffer(prefixDir string, settings extractionSettings) (differ bool, formatDiffers bool) {
+	extracted := extractionSettings{InfoFiles: defaultInfoFileSpecs}
+	if data, err := ioutil.ReadFile(filepath.Join(prefixDir, extractionSettingsFilename)); err == nil {
+		extracted = extractionSettings{}
+		if err = json.Unmarshal(data, &extracted); err != nil {
+			return true, true
+		}
+	}
+	formatDiffers = extracted.DocumentFormat != settings.DocumentFormat
+	extracted.DocumentFormat = settings.DocumentFormat
+	return !reflect.DeepEqual(extracted, settings), formatDiffers
+}
+
+// addInfoFilesToDocument adds the info files extracted into prefixDir to the metadata document res, as
+// specs tell. Files that are missing or cannot be read in their format are left out.
+func addInfoFilesToDocument(prefixDir string, specs []domain.InfoFileSpec, res map[string]interface{}) {
+	logger := helpers.GetAppLogger()
+
+	for _, spec := range specs {
+		if spec.Key == "" {
+			continue
+		}
+
+		if !helpers.IsPathGlob(spec.Path) {
+			filename := filepath.Join(prefixDir, filepath.FromSlash(spec.Path))
+			if _, err := os.Stat(filename); err != nil {
+				continue
+			}
+			if val, err := readInfoFile(filename, spec); err == nil {
+				res[spec.Key] = val
+			}
+			continue
+		}
+
+		matches := make(map[string]interface{})
+		err := filepath.Walk(prefixDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(prefixDir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !helpers.MatchPathGlob(spec.Path, rel) {
+				return nil
+			}
+			if val, err := readInfoFile(path, spec); err == nil {
+				matches[rel] = val
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Printf("[ERROR] Could not look for files matching %s in %s: %s", spec.Path, prefixDir, err.Error())
+			continue
+		}
+		if len(matches) > 0 {
+			res[spec.Key] = matches
+		}
+	}
+}
+
+// readInfoFile reads filename in the format of spec.
+func readInfoFile(filename string, spec domain.InfoFileSpec) (interface{}, error) {
+	logger := helpers.GetAppLogger()
+
+	switch spec.Format {
+	case domain.InfoFileFormatJson:
+		if spec.Member != "" {
+			obj, err := readJsonFromFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			return obj[spec.Member], nil
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var val interface{}
+		if err = json.Unmarshal(data, &val); err != nil {
+			return nil, logger.ErrorPrintf("could not parse %s as json: %s", filename, err.Error())
+		}
+		return val, nil
+	case domain.InfoFileFormatLines:
+		obj, err := readLinesIntoJsonArray(filename, "lines")
+		if err != nil {
+			return nil, err
+		}
+		return obj["lines"], nil
+	case domain.InfoFileFormatRaw, "":
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	default:
+		return nil, logger.ErrorPrintf("unknown format %s of info file %s: must be one of {raw, json, lines}", spec.Format, spec.Path)
+	}
+}
@@ -0,0 +1,325 @@
+package indexer
+
+import (
+	"bytes"
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/renameio"
+	"golang.org/x/crypto/blake2b"
+)
+
+// jlapState is kept in the subdir workdir between runs to fetch repodata incrementally through repodata.jlap.
+type jlapState struct {
+	// Have is the blake2b-256 hash of the repodata.json that the cached repodata is identical to
+	Have string `json:"have"`
+
+	// Offset is where the lines of repodata.jlap that have not been seen yet start, and Iv is
+	// the chain hash of the lines before it
+	Offset int64  `json:"offset"`
+	Iv     string `json:"iv"`
+}
+
+// jlapPatch is a line of repodata.jlap that turns the repodata.json with hash From into the one with hash To.
+type jlapPatch struct {
+	From  string                       `json:"from"`
+	To    string                       `json:"to"`
+	Patch []helpers.JsonPatchOperation `json:"patch"`
+}
+
+// jlapFile is the content of repodata.jlap, or of the lines appended to it since an earlier read.
+type jlapFile struct {
+	patches map[string]jlapPatch // keyed by From
+	latest  string
+
+	// Where the metadata line, i.e. the lines that are rewritten as patches are added, starts
+	// and the chain hash of the lines before it
+	offset int64
+	iv     string
+}
+
+// readInRepodataWithJlap reads the current repodata of subdir s from src through its repodata.jlap. The
+// repodata is cached in workDir and the JSON patches published in repodata.jlap since the last run are
+// applied to it, so that only the tail of repodata.jlap has to be fetched. The full repodata is fetched from
+// repodataLocation the first time, and whenever the patches do not lead from the cached repodata to the latest.
+// If src has no repodata.jlap for s, the full repodata is read as is.
+func readInRepodataWithJlap(s domain.Subdir, src domain.CondaChannelFileSource, workDir string, repodataLocation string) (*domain.CondaRepodata, error) {
+	logger := helpers.GetAppLogger()
+
+	jlapLocation := filepath.Join(s.RelativeLocation, "repodata.jlap")
+	exists, err := src.FileExists(jlapLocation)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not check for %s: %s", jlapLocation, err.Error())
+	}
+	if !exists {
+		logger.Printf("[INFO] No repodata.jlap found for subdirectory %s, reading full repodata", s.RelativeLocation)
+		return readInRepodataFromSource(repodataLocation, src)
+	}
+
+	stateFilename := filepath.Join(workDir, "repodata.json.jlap-state")
+	cacheFilename := filepath.Join(workDir, "repodata.json.jlap-cache")
+
+	state := readInJlapState(stateFilename, cacheFilename)
+	jlap, err := fetchJlap(src, jlapLocation, state)
+	if err != nil {
+		logger.Printf("[INFO] Could not read %s, reading full repodata instead: %s", jlapLocation, err.Error())
+		return readInRepodataFromSource(repodataLocation, src)
+	}
+
+	if state.Have == "" || !jlap.leadsToLatest(state.Have) {
+		logger.Printf("[INFO] Fetching full repodata %s as the patches in %s do not apply to the cached one", repodataLocation, jlapLocation)
+		if state.Have, err = fetchRepodataIntoFile(src, repodataLocation, cacheFilename); err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Have != jlap.latest {
+		if jlap.leadsToLatest(state.Have) {
+			if err = applyJlapPatchesToFile(cacheFilename, jlap, state.Have); err != nil {
+				return nil, logger.ErrorPrintf("could not patch cached repodata of %s: %s", s.RelativeLocation, err.Error())
+			}
+			state.Have = jlap.latest
+		} else {
+			logger.Printf("[INFO] Full repodata %s is not in %s yet, using it as is", repodataLocation, jlapLocation)
+		}
+	} else {
+		logger.Printf("[DEBUG] Cached repodata of %s is the latest one", s.RelativeLocation)
+	}
+
+	state.Offset, state.Iv = jlap.offset, jlap.iv
+	if err = writeJlapState(stateFilename, state); err != nil {
+		return nil, err
+	}
+
+	return readInRepodataFile(cacheFilename)
+}
+
+// readInJlapState reads the jlap state from stateFilename. A blank state is returned if there is none or
+// if the cached repodata is missing.
+func readInJlapState(stateFilename string, cacheFilename string) jlapState {
+	logger := helpers.GetAppLogger()
+
+	var state jlapState
+	data, err := ioutil.ReadFile(stateFilename)
+	if err != nil {
+		return state
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		logger.Printf("[INFO] Ignoring unreadable jlap state %s: %s", stateFilename, err.Error())
+		return jlapState{}
+	}
+	if _, err = os.Stat(cacheFilename); err != nil {
+		state.Have = ""
+	}
+
+	return state
+}
+
+func writeJlapState(stateFilename string, state jlapState) error {
+	logger := helpers.GetAppLogger()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return logger.ErrorPrintf("could not serialize jlap state: %s", err.Error())
+	}
+	if err = renameio.WriteFile(stateFilename, data, 0644); err != nil {
+		return logger.ErrorPrintf("could not write jlap state %s: %s", stateFilename, err.Error())
+	}
+	return nil
+}
+
+// fetchJlap reads repodata.jlap from src. If state tells where reading stopped the last time and src supports
+// byte ranges, only the lines from there on are fetched; otherwise, or if the file has been rewritten since,
+// the whole file is.
+func fetchJlap(src domain.CondaChannelFileSource, jlapLocation string, state jlapState) (*jlapFile, error) {
+	logger := helpers.GetAppLogger()
+
+	if rangeSrc, ok := src.(domain.CondaChannelRangeFileSource); ok && state.Offset > 0 && state.Iv != "" {
+		tail, err := readJlapTail(rangeSrc, jlapLocation, state.Offset)
+		if err == nil {
+			var res *jlapFile
+			if res, err = parseJlap(tail, state.Offset, state.Iv); err == nil {
+				return res, nil
+			}
+		}
+		logger.Printf("[DEBUG] Could not continue reading %s from offset %d, reading it whole: %s", jlapLocation, state.Offset, err.Error())
+	}
+
+	r, err := src.GetFileReadCloser(jlapLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("missing iv line")
+	}
+	return parseJlap(data[i+1:], int64(i+1), string(data[:i]))
+}
+
+// readJlapTail reads repodata.jlap from offset on.
+func readJlapTail(src domain.CondaChannelRangeFileSource, jlapLocation string, offset int64) ([]byte, error) {
+	ra, size, err := src.GetFileReaderAt(jlapLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+
+	if size <= offset {
+		return nil, fmt.Errorf("file is not longer than %d bytes", offset)
+	}
+
+	tail := make([]byte, size-offset)
+	if _, err = ra.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return tail, nil
+}
+
+// parseJlap parses the lines of repodata.jlap found at offset: zero or more patch lines, the metadata line and
+// the trailing checksum line. The blake2b-256 hash chain of the lines, which starts with the hex-encoded iv,
+// must end in the checksum line.
+func parseJlap(data []byte, offset int64, iv string) (*jlapFile, error) {
+	chain, err := hex.DecodeString(iv)
+	if err != nil || len(chain) != blake2b.Size256 {
+		return nil, fmt.Errorf("invalid jlap iv %q", iv)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("missing metadata and checksum lines")
+	}
+
+	res := jlapFile{
+		patches: make(map[string]jlapPatch),
+		offset:  offset,
+		iv:      iv,
+	}
+	for i, line := range lines[:len(lines)-1] {
+		h, err := blake2b.New256(chain)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(line)
+		chain = h.Sum(nil)
+
+		if i < len(lines)-2 {
+			var patch jlapPatch
+			if err = json.Unmarshal(line, &patch); err != nil {
+				return nil, fmt.Errorf("could not parse patch line: %s", err.Error())
+			}
+			res.patches[patch.From] = patch
+			res.offset += int64(len(line)) + 1
+			res.iv = hex.EncodeToString(chain)
+		} else {
+			var metadata struct {
+				Latest string `json:"latest"`
+			}
+			if err = json.Unmarshal(line, &metadata); err != nil {
+				return nil, fmt.Errorf("could not parse metadata line: %s", err.Error())
+			}
+			res.latest = metadata.Latest
+		}
+	}
+
+	if checksum := string(lines[len(lines)-1]); checksum != hex.EncodeToString(chain) {
+		return nil, fmt.Errorf("checksum mismatch: expected %s, computed %s", checksum, hex.EncodeToString(chain))
+	}
+
+	return &res, nil
+}
+
+// leadsToLatest tells if there is a chain of patches from the repodata with hash have to the latest one.
+func (j *jlapFile) leadsToLatest(have string) bool {
+	for n := 0; have != j.latest; n++ {
+		patch, ok := j.patches[have]
+		if !ok || n > len(j.patches) {
+			return false
+		}
+		have = patch.To
+	}
+	return true
+}
+
+// fetchRepodataIntoFile writes the decompressed repodata at repodataLocation in src to filename as is,
+// and returns its hex-encoded blake2b-256 hash.
+func fetchRepodataIntoFile(src domain.CondaChannelFileSource, repodataLocation string, filename string) (string, error) {
+	logger := helpers.GetAppLogger()
+
+	r, err := src.GetFileReadCloser(repodataLocation)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not read repodata %s: %s", repodataLocation, err.Error())
+	}
+	defer r.Close()
+
+	decompReader, err := helpers.NewDecompressingReadCloser(repodataLocation, r)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not decompress repodata %s: %s", repodataLocation, err.Error())
+	}
+	defer decompReader.Close()
+
+	f, err := renameio.TempFile("", filename)
+	if err != nil {
+		return "", logger.ErrorPrintf("could not open temp file for %s: %s", filename, err.Error())
+	}
+	//nolint:errcheck
+	defer f.Cleanup()
+
+	h, _ := blake2b.New256(nil)
+	if _, err = io.Copy(io.MultiWriter(f, h), decompReader); err != nil {
+		return "", logger.ErrorPrintf("could not fetch repodata %s into %s: %s", repodataLocation, filename, err.Error())
+	}
+	if err = f.CloseAtomicallyReplace(); err != nil {
+		return "", logger.ErrorPrintf("could not replace %s: %s", filename, err.Error())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// applyJlapPatchesToFile applies the chain of patches in jlap from the repodata with hash have to the
+// latest one to the repodata in filename.
+func applyJlapPatchesToFile(filename string, jlap *jlapFile, have string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	err = json.NewDecoder(f).Decode(&doc)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", filename, err.Error())
+	}
+
+	for have != jlap.latest {
+		patch := jlap.patches[have]
+		if doc, err = helpers.ApplyJsonPatch(doc, patch.Patch); err != nil {
+			return fmt.Errorf("could not apply patch from %s to %s: %s", patch.From, patch.To, err.Error())
+		}
+		have = patch.To
+	}
+
+	tmp, err := renameio.TempFile("", filename)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer tmp.Cleanup()
+
+	if err = json.NewEncoder(tmp).Encode(doc); err != nil {
+		return err
+	}
+	return tmp.CloseAtomicallyReplace()
+}
@@ -0,0 +1,213 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// fakeJlapChannel publishes successive versions of the repodata of the subdir "ch/linux-64", along with a
+// repodata.jlap holding the patches between them.
+type fakeJlapChannel struct {
+	t   *testing.T
+	dir string
+
+	repodata []byte
+	iv       string
+	patches  []string
+}
+
+func newFakeJlapChannel(t *testing.T, repodata string) *fakeJlapChannel {
+	c := &fakeJlapChannel{t: t, dir: t.TempDir(), iv: strings.Repeat("00", blake2b.Size256)}
+	if err := os.MkdirAll(filepath.Join(c.dir, "ch", "linux-64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.repodata = []byte(repodata)
+	c.write()
+	return c
+}
+
+func jlapHash(data []byte) string {
+	sum := blake2b.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// publish makes repodata the latest, with patch leading to it from the previous one.
+func (c *fakeJlapChannel) publish(repodata string, patch string) {
+	line, err := json.Marshal(map[string]interface{}{
+		"from":  jlapHash(c.repodata),
+		"to":    jlapHash([]byte(repodata)),
+		"patch": json.RawMessage(patch),
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.patches = append(c.patches, string(line))
+	c.repodata = []byte(repodata)
+	c.write()
+}
+
+func (c *fakeJlapChannel) write() {
+	lines := append(append([]string(nil), c.patches...), `{"url": "repodata.json", "latest": "`+jlapHash(c.repodata)+`"}`)
+	chain, _ := hex.DecodeString(c.iv)
+	for _, line := range lines {
+		h, _ := blake2b.New256(chain)
+		h.Write([]byte(line))
+		chain = h.Sum(nil)
+	}
+	jlap := c.iv + "\n" + strings.Join(lines, "\n") + "\n" + hex.EncodeToString(chain) + "\n"
+
+	c.writeFile("repodata.json", string(c.repodata))
+	c.writeFile("repodata.jlap", jlap)
+}
+
+func (c *fakeJlapChannel) writeFile(name string, data string) {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "ch", "linux-64", name), []byte(data), 0644); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// countingSource is a local source that counts the files read from it, whole or by range.
+type countingSource struct {
+	*helpers.LocalFileSource
+	reads      map[string]int
+	rangeReads map[string]int
+}
+
+func (c *fakeJlapChannel) source() *countingSource {
+	src := &countingSource{
+		LocalFileSource: &helpers.LocalFileSource{SourceDir: c.dir, TempDir: c.t.TempDir()},
+		reads:           make(map[string]int),
+		rangeReads:      make(map[string]int),
+	}
+	if err := src.Init(); err != nil {
+		c.t.Fatal(err)
+	}
+	return src
+}
+
+func (s *countingSource) GetFileReadCloser(relativeFilepath string) (io.ReadCloser, error) {
+	s.reads[filepath.Base(relativeFilepath)]++
+	return s.LocalFileSource.GetFileReadCloser(relativeFilepath)
+}
+
+func (s *countingSource) GetFileReaderAt(relativeFilepath string) (domain.ReadAtCloser, int64, error) {
+	s.rangeReads[filepath.Base(relativeFilepath)]++
+	return s.LocalFileSource.GetFileReaderAt(relativeFilepath)
+}
+
+const (
+	jlapRepodataV0 = `{"packages": {"foo-1.0-0.tar.bz2": {"name": "foo", "version": "1.0", "depends": []}}, "packages.conda": {}}`
+	jlapRepodataV1 = `{"packages": {"foo-1.0-0.tar.bz2": {"name": "foo", "version": "1.0", "depends": ["bar"]}}, "packages.conda": {"foo-1.1-0.conda": {"name": "foo", "version": "1.1"}}}`
+	jlapRepodataV2 = `{"packages": {"foo-1.0-0.tar.bz2": {"name": "foo", "version": "1.0", "depends": ["bar"]}, "a/b~c": {"name": "odd"}}, "packages.conda": {}}`
+
+	jlapPatchV0V1 = `[{"op": "add", "path": "/packages/foo-1.0-0.tar.bz2/depends/-", "value": "bar"}, {"op": "add", "path": "/packages.conda/foo-1.1-0.conda", "value": {"name": "foo", "version": "1.1"}}]`
+	jlapPatchV1V2 = `[{"op": "move", "from": "/packages.conda/foo-1.1-0.conda", "path": "/packages/a~1b~0c"}, {"op": "replace", "path": "/packages/a~1b~0c", "value": {"name": "odd"}}]`
+)
+
+// readFullRepodata reads the repodata published in c the way it is without repodata.jlap.
+func (c *fakeJlapChannel) readFullRepodata() *domain.CondaRepodata {
+	r, err := readInRepodataFromSource("ch/linux-64/repodata.json", c.source())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return r
+}
+
+func TestReadInRepodataWithJlapResumes(t *testing.T) {
+	c := newFakeJlapChannel(t, jlapRepodataV0)
+	s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+	workDir := t.TempDir()
+
+	r, err := readInRepodataWithJlap(s, c.source(), workDir, "ch/linux-64/repodata.json")
+	if err != nil {
+		t.Fatalf("first readInRepodataWithJlap: %s", err)
+	}
+	if !reflect.DeepEqual(r, c.readFullRepodata()) {
+		t.Errorf("first run: got %+v", r)
+	}
+
+	for _, v := range []struct {
+		repodata string
+		patch    string
+	}{
+		{jlapRepodataV1, jlapPatchV0V1},
+		{jlapRepodataV2, jlapPatchV1V2},
+	} {
+		state := readInJlapState(filepath.Join(workDir, "repodata.json.jlap-state"), filepath.Join(workDir, "repodata.json.jlap-cache"))
+		c.publish(v.repodata, v.patch)
+		src := c.source()
+
+		r, err = readInRepodataWithJlap(s, src, workDir, "ch/linux-64/repodata.json")
+		if err != nil {
+			t.Fatalf("readInRepodataWithJlap of version %d: %s", len(c.patches), err)
+		}
+		if want := c.readFullRepodata(); !reflect.DeepEqual(r, want) {
+			t.Errorf("version %d: got %+v, want %+v", len(c.patches), r, want)
+		}
+
+		// Only the tail of repodata.jlap is read, from where the last run stopped
+		if src.reads["repodata.json"] != 0 || src.reads["repodata.jlap"] != 0 || src.rangeReads["repodata.jlap"] != 1 {
+			t.Errorf("version %d: got reads %v and range reads %v, want a range read of repodata.jlap only", len(c.patches), src.reads, src.rangeReads)
+		}
+		newState := readInJlapState(filepath.Join(workDir, "repodata.json.jlap-state"), filepath.Join(workDir, "repodata.json.jlap-cache"))
+		if newState.Offset <= state.Offset || newState.Have != jlapHash(c.repodata) {
+			t.Errorf("version %d: got state %+v after %+v", len(c.patches), newState, state)
+		}
+	}
+}
+
+func TestReadInRepodataWithJlapFallsBackToFullFetch(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		breakJlap func(c *fakeJlapChannel)
+	}{
+		{"missing link", func(c *fakeJlapChannel) {
+			// The patch from the cached repodata is gone
+			c.publish(jlapRepodataV1, jlapPatchV0V1)
+			c.patches = c.patches[1:]
+			c.publish(jlapRepodataV2, jlapPatchV1V2)
+		}},
+		{"bad checksum", func(c *fakeJlapChannel) {
+			c.publish(jlapRepodataV1, jlapPatchV0V1)
+			c.writeFile("repodata.jlap", c.iv+"\n"+c.patches[0]+"\n"+`{"latest": "`+jlapHash(c.repodata)+`"}`+"\n"+strings.Repeat("ab", blake2b.Size256)+"\n")
+		}},
+		{"rewritten", func(c *fakeJlapChannel) {
+			// Started over with another iv, from repodata that was never cached
+			c.iv = strings.Repeat("11", blake2b.Size256)
+			c.repodata = []byte(`{"packages": {}, "packages.conda": {}}`)
+			c.publish(jlapRepodataV1, `[{"op": "add", "path": "/packages/foo-1.0-0.tar.bz2", "value": {}}]`)
+		}},
+	} {
+		c := newFakeJlapChannel(t, jlapRepodataV0)
+		s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+		workDir := t.TempDir()
+		if _, err := readInRepodataWithJlap(s, c.source(), workDir, "ch/linux-64/repodata.json"); err != nil {
+			t.Fatalf("%s: first readInRepodataWithJlap: %s", tc.desc, err)
+		}
+
+		tc.breakJlap(c)
+		src := c.source()
+		r, err := readInRepodataWithJlap(s, src, workDir, "ch/linux-64/repodata.json")
+		if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		if want := c.readFullRepodata(); !reflect.DeepEqual(r, want) {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, r, want)
+		}
+		if src.reads["repodata.json"] != 1 {
+			t.Errorf("%s: got %d full reads of repodata.json, want 1", tc.desc, src.reads["repodata.json"])
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package indexer
+
+import (
+	"conda-rlookup/helpers"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := helpers.InitAppLogger(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,122 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// revokedDependency is the dependency conda-index adds to revoked packages so that they can never be installed.
+const revokedDependency = "package_has_been_revoked"
+
+// readInPatchInstructionsFromSource reads the patch_instructions.json of subdir s from src.
+// nil is returned without an error if the subdir has no patch instructions.
+func readInPatchInstructionsFromSource(s domain.Subdir, src domain.CondaChannelFileSource) (*domain.CondaPatchInstructions, error) {
+	logger := helpers.GetAppLogger()
+
+	fileref := filepath.Join(s.RelativeLocation, "patch_instructions.json")
+	exists, err := src.FileExists(fileref)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not check for patch instructions %s: %s", fileref, err.Error())
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	r, err := src.GetFileReadCloser(fileref)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not read patch instructions %s: %s", fileref, err.Error())
+	}
+	defer r.Close()
+
+	var res domain.CondaPatchInstructions
+	if err = json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, logger.ErrorPrintf("could not read and parse patch instructions %s: %s", fileref, err.Error())
+	}
+
+	return &res, nil
+}
+
+// applyPatchInstructions applies instructions to repodata in place, the same way conda-index does:
+//   - The fields listed for a package under "packages"/"packages.conda" are merged into its repodata entry.
+//     Fixes listed for a .tar.bz2 package also apply to the .conda package of the same name.
+//   - Packages listed under "revoke" are flagged as revoked and made uninstallable.
+//   - Packages listed under "remove" are dropped from the repodata and added to its "removed" list.
+//
+// Instructions for packages that are not present in repodata are ignored.
+func applyPatchInstructions(repodata *domain.CondaRepodata, instructions *domain.CondaPatchInstructions) {
+	for name, fixes := range instructions.Packages {
+		if pkg, ok := repodata.Packages[name]; ok {
+			mergePatchIntoMap(pkg, fixes)
+		}
+		if pkg, ok := repodata.PackagesConda[condaV2PackageName(name)]; ok {
+			mergePatchIntoMap(pkg, fixes)
+		}
+	}
+	for name, fixes := range instructions.PackagesConda {
+		if pkg, ok := repodata.PackagesConda[name]; ok {
+			mergePatchIntoMap(pkg, fixes)
+		}
+	}
+
+	for _, name := range instructions.Revoke {
+		for _, pkg := range []domain.CondaPackage{repodata.Packages[name], repodata.PackagesConda[condaV2PackageName(name)]} {
+			if pkg == nil {
+				continue
+			}
+			pkg["revoked"] = true
+			depends, _ := pkg["depends"].([]interface{})
+			if !containsString(depends, revokedDependency) {
+				pkg["depends"] = append(depends, revokedDependency)
+			}
+		}
+	}
+
+	for _, name := range instructions.Remove {
+		if _, ok := repodata.Packages[name]; ok {
+			delete(repodata.Packages, name)
+			repodata.Removed = append(repodata.Removed, name)
+		}
+		if v2Name := condaV2PackageName(name); repodata.PackagesConda[v2Name] != nil {
+			delete(repodata.PackagesConda, v2Name)
+			repodata.Removed = append(repodata.Removed, v2Name)
+		}
+	}
+	sort.Strings(repodata.Removed)
+}
+
+// mergePatchIntoMap sets every field of patch on dst. Fields which are objects on both sides are merged
+// recursively, while everything else (including nulls and arrays) replaces the value in dst.
+func mergePatchIntoMap(dst map[string]interface{}, patch map[string]interface{}) {
+	for k, v := range patch {
+		if patchObj, ok := v.(map[string]interface{}); ok {
+			if dstObj, ok := dst[k].(map[string]interface{}); ok {
+				mergePatchIntoMap(dstObj, patchObj)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// condaV2PackageName returns the .conda filename of the package named by a .tar.bz2 filename.
+// Other filenames are returned as is.
+func condaV2PackageName(name string) string {
+	if strings.HasSuffix(name, ".tar.bz2") {
+		return strings.TrimSuffix(name, ".tar.bz2") + ".conda"
+	}
+	return name
+}
+
+// containsString tells if arr has an element that is the string s.
+func containsString(arr []interface{}, s string) bool {
+	for _, v := range arr {
+		if str, ok := v.(string); ok && str == s {
+			return true
+		}
+	}
+	return false
+}
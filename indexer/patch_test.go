@@ -0,0 +1,128 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPatchInstructions(t *testing.T) {
+	const repodata = `{
+		"packages": {
+			"foo-1.0-0.tar.bz2": {"name": "foo", "depends": ["python"], "license": "MIT", "extra": {"a": 1, "b": 2}},
+			"bar-1.0-0.tar.bz2": {"name": "bar"}
+		},
+		"packages.conda": {
+			"foo-1.0-0.conda": {"name": "foo", "depends": ["python"], "license": "MIT", "extra": {"a": 1, "b": 2}},
+			"baz-1.0-0.conda": {"name": "baz"}
+		}
+	}`
+
+	for _, tc := range []struct {
+		desc         string
+		instructions string
+		want         string
+	}{
+		{
+			"no instructions",
+			`{}`,
+			repodata,
+		},
+		{
+			".tar.bz2 fixes apply to the .conda package too",
+			`{"packages": {"foo-1.0-0.tar.bz2": {"depends": ["python >=3.8"], "license": null, "extra": {"b": 3}}}}`,
+			`{
+				"packages": {
+					"foo-1.0-0.tar.bz2": {"name": "foo", "depends": ["python >=3.8"], "license": null, "extra": {"a": 1, "b": 3}},
+					"bar-1.0-0.tar.bz2": {"name": "bar"}
+				},
+				"packages.conda": {
+					"foo-1.0-0.conda": {"name": "foo", "depends": ["python >=3.8"], "license": null, "extra": {"a": 1, "b": 3}},
+					"baz-1.0-0.conda": {"name": "baz"}
+				}
+			}`,
+		},
+		{
+			"packages.conda fixes override .tar.bz2 ones",
+			`{
+				"packages": {"foo-1.0-0.tar.bz2": {"license": "BSD"}},
+				"packages.conda": {"foo-1.0-0.conda": {"license": "Apache-2.0"}, "baz-1.0-0.conda": {"track_features": "x"}}
+			}`,
+			`{
+				"packages": {
+					"foo-1.0-0.tar.bz2": {"name": "foo", "depends": ["python"], "license": "BSD", "extra": {"a": 1, "b": 2}},
+					"bar-1.0-0.tar.bz2": {"name": "bar"}
+				},
+				"packages.conda": {
+					"foo-1.0-0.conda": {"name": "foo", "depends": ["python"], "license": "Apache-2.0", "extra": {"a": 1, "b": 2}},
+					"baz-1.0-0.conda": {"name": "baz", "track_features": "x"}
+				}
+			}`,
+		},
+		{
+			"fixes of missing packages are ignored",
+			`{"packages": {"qux-1.0-0.tar.bz2": {"license": "BSD"}}, "packages.conda": {"bar-1.0-0.conda": {"license": "BSD"}}}`,
+			repodata,
+		},
+		{
+			"revoke flags packages and makes them uninstallable",
+			`{"revoke": ["foo-1.0-0.tar.bz2", "bar-1.0-0.tar.bz2", "qux-1.0-0.tar.bz2"]}`,
+			`{
+				"packages": {
+					"foo-1.0-0.tar.bz2": {"name": "foo", "depends": ["python", "package_has_been_revoked"], "license": "MIT", "extra": {"a": 1, "b": 2}, "revoked": true},
+					"bar-1.0-0.tar.bz2": {"name": "bar", "depends": ["package_has_been_revoked"], "revoked": true}
+				},
+				"packages.conda": {
+					"foo-1.0-0.conda": {"name": "foo", "depends": ["python", "package_has_been_revoked"], "license": "MIT", "extra": {"a": 1, "b": 2}, "revoked": true},
+					"baz-1.0-0.conda": {"name": "baz"}
+				}
+			}`,
+		},
+		{
+			"revoking twice adds the dependency once",
+			`{"packages": {"bar-1.0-0.tar.bz2": {"depends": ["package_has_been_revoked"]}}, "revoke": ["bar-1.0-0.tar.bz2"]}`,
+			`{
+				"packages": {
+					"foo-1.0-0.tar.bz2": {"name": "foo", "depends": ["python"], "license": "MIT", "extra": {"a": 1, "b": 2}},
+					"bar-1.0-0.tar.bz2": {"name": "bar", "depends": ["package_has_been_revoked"], "revoked": true}
+				},
+				"packages.conda": {
+					"foo-1.0-0.conda": {"name": "foo", "depends": ["python"], "license": "MIT", "extra": {"a": 1, "b": 2}},
+					"baz-1.0-0.conda": {"name": "baz"}
+				}
+			}`,
+		},
+		{
+			"remove drops packages into the removed list",
+			`{"remove": ["foo-1.0-0.tar.bz2", "baz-1.0-0.conda", "qux-1.0-0.tar.bz2"]}`,
+			`{
+				"packages": {
+					"bar-1.0-0.tar.bz2": {"name": "bar"}
+				},
+				"packages.conda": {},
+				"removed": ["baz-1.0-0.conda", "foo-1.0-0.conda", "foo-1.0-0.tar.bz2"]
+			}`,
+		},
+	} {
+		var got domain.CondaRepodata
+		if err := json.Unmarshal([]byte(repodata), &got); err != nil {
+			t.Fatal(err)
+		}
+		var instructions domain.CondaPatchInstructions
+		if err := json.Unmarshal([]byte(tc.instructions), &instructions); err != nil {
+			t.Fatalf("%s: bad instructions: %s", tc.desc, err)
+		}
+		var want domain.CondaRepodata
+		if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+			t.Fatalf("%s: bad want: %s", tc.desc, err)
+		}
+
+		applyPatchInstructions(&got, &instructions)
+
+		if !reflect.DeepEqual(got, want) {
+			data, _ := json.MarshalIndent(got, "", "  ")
+			t.Errorf("%s: got %s", tc.desc, data)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package indexer
+
+import (
+	"bufio"
+	"conda-rlookup/helpers"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pkgconfigFilesGlob matches the pkg-config files of packages (lib/pkgconfig, share/pkgconfig and their
+// Library/ counterparts on Windows), which are extracted to read their Name and Version from.
+const pkgconfigFilesGlob = "**/pkgconfig/*.pc"
+
+// PkgconfigProvide is a pkg-config module provided by a package.
+type PkgconfigProvide struct {
+	Module  string `json:"module"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path"`
+}
+
+// CmakeProvide is a CMake package, as found by find_package in config mode, provided by a package.
+type CmakeProvide struct {
+	Package string `json:"package"`
+	Path    string `json:"path"`
+}
+
+// BuildProvides is what a package provides to builds against it.
+type BuildProvides struct {
+	Pkgconfig []PkgconfigProvide `json:"pkgconfig"`
+	Cmake     []CmakeProvide     `json:"cmake"`
+
+	// Headers are relative to the include directory, e.g. "openssl/ssl.h"
+	Headers []string `json:"headers"`
+}
+
+// Kinds of build provides
+const (
+	ProvideKindPkgconfig = "pkgconfig"
+	ProvideKindCmake     = "cmake"
+	ProvideKindHeader    = "header"
+)
+
+// buildProvides derives the build provides of a package from its files, and the pkg-config files of
+// the package extracted into prefixDir. The lists are in order, and never nil.
+func buildProvides(prefixDir string, files []string) BuildProvides {
+	res := BuildProvides{
+		Pkgconfig: []PkgconfigProvide{},
+		Cmake:     []CmakeProvide{},
+		Headers:   []string{},
+	}
+
+	for _, f := range files {
+		dir, base := path.Split(f)
+		switch {
+		case helpers.MatchPathGlob(pkgconfigFilesGlob, f):
+			provide := PkgconfigProvide{Module: strings.TrimSuffix(base, ".pc"), Path: f}
+			if err := readPkgconfigFile(filepath.Join(prefixDir, filepath.FromSlash(f)), &provide); err != nil && !os.IsNotExist(err) {
+				helpers.GetAppLogger().Printf("[DEBUG] Could not read pkg-config file %s: %s", f, err.Error())
+			}
+			res.Pkgconfig = append(res.Pkgconfig, provide)
+		case path.Base(path.Dir(path.Dir(f))) == "cmake":
+			if pkg := cmakeConfigPackage(base); pkg != "" {
+				res.Cmake = append(res.Cmake, CmakeProvide{Package: pkg, Path: f})
+			}
+		default:
+			if i := strings.Index("/"+dir, "/include/"); i == 0 || (i > 0 && f[:i] == "Library/") {
+				res.Headers = append(res.Headers, f[i+len("include/"):])
+			}
+		}
+	}
+
+	sort.Slice(res.Pkgconfig, func(i, j int) bool { return res.Pkgconfig[i].Path < res.Pkgconfig[j].Path })
+	sort.Slice(res.Cmake, func(i, j int) bool { return res.Cmake[i].Path < res.Cmake[j].Path })
+	sort.Strings(res.Headers)
+	return res
+}
+
+// cmakeConfigPackage returns the name of the CMake package whose config file is named base, or "" if it is not
+// one: <Package>Config.cmake or <package>-config.cmake.
+func cmakeConfigPackage(base string) string {
+	for _, suffix := range []string{"Config.cmake", "-config.cmake"} {
+		if pkg := strings.TrimSuffix(base, suffix); pkg != base && pkg != "" {
+			return pkg
+		}
+	}
+	return ""
+}
+
+var pkgconfigVariableRef = regexp.MustCompile(`\$\{([A-Za-z0-9_.]+)\}`)
+
+// readPkgconfigFile reads the Name and Version of the pkg-config file filename into provide, expanding the
+// variables defined in the file.
+func readPkgconfigFile(filename string, provide *PkgconfigProvide) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	expand := func(val string) string {
+		return pkgconfigVariableRef.ReplaceAllStringFunc(val, func(ref string) string {
+			return vars[pkgconfigVariableRef.FindStringSubmatch(ref)[1]]
+		})
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Keywords are "Key: value" and variables "key=value", whichever comes first
+		i := strings.IndexAny(line, ":=")
+		if i < 0 {
+			continue
+		}
+		key, val := strings.TrimSpace(line[:i]), expand(strings.TrimSpace(line[i+1:]))
+		if line[i] == '=' {
+			vars[key] = val
+			continue
+		}
+		switch key {
+		case "Name":
+			provide.Name = val
+		case "Version":
+			provide.Version = val
+		}
+	}
+	return scanner.Err()
+}
+
+// matchesBuildProvide tells if the build provides in a metadata document, as read back, provide name of kind.
+func matchesBuildProvide(provides map[string]interface{}, kind string, name string) (string, bool) {
+	switch kind {
+	case ProvideKindPkgconfig, ProvideKindCmake:
+		key, field := "pkgconfig", "module"
+		if kind == ProvideKindCmake {
+			key, field = "cmake", "package"
+		}
+		entries, _ := provides[key].([]interface{})
+		for _, entry := range entries {
+			obj, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			val, _ := obj[field].(string)
+			// find_package matches config files case-insensitively
+			if val == name || (kind == ProvideKindCmake && strings.EqualFold(val, name)) {
+				p, _ := obj["path"].(string)
+				return p, true
+			}
+		}
+	case ProvideKindHeader:
+		headers, _ := provides["headers"].([]interface{})
+		for _, header := range headers {
+			if header == name {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ProvideMatch is a package that provides something to builds.
+type ProvideMatch struct {
+	Package string `json:"package"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	Path    string `json:"path"`
+}
+
+// FindSubdirBuildProvides returns the packages of the subdir whose working directory is workDir that provide
+// name of kind (one of the ProvideKind* ones) to builds, in order.
+func FindSubdirBuildProvides(workDir string, kind string, name string) ([]ProvideMatch, error) {
+	if kind != ProvideKindPkgconfig && kind != ProvideKindCmake && kind != ProvideKindHeader {
+		return nil, fmt.Errorf("unknown kind %s: must be one of {%s, %s, %s}", kind, ProvideKindPkgconfig, ProvideKindCmake, ProvideKindHeader)
+	}
+
+	var res []ProvideMatch
+	err := WalkPackageDocuments(workDir, func(pkg PackageDocument) error {
+		provides, ok := pkg.Doc["provides"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if p, ok := matchesBuildProvide(provides, kind, name); ok {
+			res = append(res, ProvideMatch{
+				Package: pkg.Filename,
+				Name:    pkg.Name,
+				Version: pkg.Version,
+				Build:   pkg.Build,
+				Path:    p,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
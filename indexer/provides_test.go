@@ -0,0 +1,119 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildProvides(t *testing.T) {
+	prefixDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(prefixDir, "lib", "pkgconfig"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(prefixDir, "lib", "pkgconfig", "openssl.pc"), []byte("Name: OpenSSL\nVersion: 3.0.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		files []string
+		want  BuildProvides
+	}{
+		{
+			"headers",
+			[]string{"include/zlib.h", "include/openssl/ssl.h", "Library/include/zconf.h", "Library/include/openssl/evp.h"},
+			BuildProvides{Pkgconfig: []PkgconfigProvide{}, Cmake: []CmakeProvide{},
+				Headers: []string{"openssl/evp.h", "openssl/ssl.h", "zconf.h", "zlib.h"}},
+		},
+		{
+			"not headers",
+			[]string{"share/include/foo.h", "lib/python3.11/include/bar.h", "Library/share/include/baz.h", "include", "includes/foo.h"},
+			BuildProvides{Pkgconfig: []PkgconfigProvide{}, Cmake: []CmakeProvide{}, Headers: []string{}},
+		},
+		{
+			"cmake config files",
+			[]string{
+				"lib/cmake/OpenSSL/OpenSSLConfig.cmake",
+				"lib/cmake/zlib/zlib-config.cmake",
+				"Library/lib/cmake/Foo/FooConfig.cmake",
+				"share/cmake/Bar/BarConfig.cmake",
+			},
+			BuildProvides{Pkgconfig: []PkgconfigProvide{}, Headers: []string{}, Cmake: []CmakeProvide{
+				{Package: "Foo", Path: "Library/lib/cmake/Foo/FooConfig.cmake"},
+				{Package: "OpenSSL", Path: "lib/cmake/OpenSSL/OpenSSLConfig.cmake"},
+				{Package: "zlib", Path: "lib/cmake/zlib/zlib-config.cmake"},
+				{Package: "Bar", Path: "share/cmake/Bar/BarConfig.cmake"},
+			}},
+		},
+		{
+			"not cmake config files",
+			[]string{
+				"lib/cmake/Foo/FooConfigVersion.cmake",
+				"lib/cmake/Foo/FooTargets.cmake",
+				"lib/cmake/FooConfig.cmake",
+				"lib/cmake/Foo/Config.cmake",
+				"lib/cmake/Foo/modules/FooConfig.cmake",
+			},
+			BuildProvides{Pkgconfig: []PkgconfigProvide{}, Cmake: []CmakeProvide{}, Headers: []string{}},
+		},
+		{
+			// Only files extracted into prefixDir are read
+			"pkg-config files",
+			[]string{"lib/pkgconfig/openssl.pc", "Library/lib/pkgconfig/zlib.pc", "share/pkgconfig/bar.pc", "lib/pkgconfig/README"},
+			BuildProvides{Cmake: []CmakeProvide{}, Headers: []string{}, Pkgconfig: []PkgconfigProvide{
+				{Module: "zlib", Path: "Library/lib/pkgconfig/zlib.pc"},
+				{Module: "openssl", Name: "OpenSSL", Version: "3.0.8", Path: "lib/pkgconfig/openssl.pc"},
+				{Module: "bar", Path: "share/pkgconfig/bar.pc"},
+			}},
+		},
+	} {
+		if got := buildProvides(prefixDir, tc.files); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestReadPkgconfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		content string
+		want    PkgconfigProvide
+	}{
+		{
+			"plain",
+			"Name: zlib\nDescription: zlib compression library\nVersion: 1.2.13\n",
+			PkgconfigProvide{Name: "zlib", Version: "1.2.13"},
+		},
+		{
+			"variables",
+			"# comment: Name: not this\nprefix=/opt/conda\nmajor=3\nminor=${major}.0\n\nName: lib${name}\nVersion: ${minor}.8\n",
+			PkgconfigProvide{Name: "lib", Version: "3.0.8"},
+		},
+		{
+			"keywords and variables with both separators",
+			"url=http://example.com\nDescription: a=b\nName: ${url}\n",
+			PkgconfigProvide{Name: "http://example.com"},
+		},
+		{
+			"neither",
+			"Requires zlib\n",
+			PkgconfigProvide{},
+		},
+	} {
+		filename := filepath.Join(t.TempDir(), "foo.pc")
+		if err := ioutil.WriteFile(filename, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var got PkgconfigProvide
+		if err := readPkgconfigFile(filename, &got); err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package indexer
+
+import (
+	"bufio"
+	"conda-rlookup/helpers"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pypiDistribution is a Python distribution installed by a package, as its metadata tells.
+type pypiDistribution struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// isPythonDistributionMetadata tells if the file at name holds the core metadata of a distribution installed
+// into site-packages: *.dist-info/METADATA, *.egg-info/PKG-INFO, or a *.egg-info file of its own.
+func isPythonDistributionMetadata(name string) bool {
+	if !strings.Contains("/"+name, "/site-packages/") {
+		return false
+	}
+	dir, base := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	return (base == "METADATA" && strings.HasSuffix(dir, ".dist-info")) ||
+		(base == "PKG-INFO" && strings.HasSuffix(dir, ".egg-info")) ||
+		strings.HasSuffix(base, ".egg-info")
+}
+
+// visitPythonDistributionMetadata records the name and version in the headers of the distribution metadata
+// at name. Metadata without a name, or that cannot be read, is passed over.
+func (d *deepScanner) visitPythonDistributionMetadata(name string, r io.Reader) error {
+	logger := helpers.GetAppLogger()
+
+	var dist pypiDistribution
+	scanner := bufio.NewScanner(io.LimitReader(r, 1<<20))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		switch strings.ToLower(line[:i]) {
+		case "name":
+			dist.Name = strings.TrimSpace(line[i+1:])
+		case "version":
+			dist.Version = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Printf("[DEBUG] Could not read Python distribution metadata %s: %s", name, err.Error())
+		return nil
+	}
+
+	if dist.Name != "" {
+		d.pypiNames[normalizePypiName(dist.Name)+"=="+dist.Version] = dist
+	}
+	return nil
+}
+
+// pythonDistributions returns the distributions found so far, in order of their normalized names. It never
+// returns nil.
+func (d *deepScanner) pythonDistributions() []pypiDistribution {
+	keys := make([]string, 0, len(d.pypiNames))
+	for key := range d.pypiNames {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]pypiDistribution, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, d.pypiNames[key])
+	}
+	return res
+}
+
+var pypiNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizePypiName normalizes the name of a Python distribution as PEP 503 does.
+func normalizePypiName(name string) string {
+	return strings.ToLower(pypiNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// PypiMapping is a Python distribution installed by a conda package.
+type PypiMapping struct {
+	PypiName           string `json:"pypi_name"`
+	PypiNormalizedName string `json:"pypi_normalized_name"`
+	PypiVersion        string `json:"pypi_version"`
+	CondaName          string `json:"conda_name"`
+	CondaVersion       string `json:"conda_version"`
+	CondaBuild         string `json:"conda_build"`
+	Package            string `json:"package"`
+}
+
+// ReadSubdirPypiMappings returns the Python distributions installed by the packages of the subdir whose working
+// directory is workDir, going by the "pypi_names" of their metadata documents, in order of package.
+func ReadSubdirPypiMappings(workDir string) ([]PypiMapping, error) {
+	var res []PypiMapping
+	err := WalkPackageDocuments(workDir, func(pkg PackageDocument) error {
+		dists, ok := pkg.Doc["pypi_names"].([]interface{})
+		if !ok {
+			return nil
+		}
+
+		for _, dist := range dists {
+			obj, ok := dist.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := obj["name"].(string)
+			version, _ := obj["version"].(string)
+			res = append(res, PypiMapping{
+				PypiName:           name,
+				PypiNormalizedName: normalizePypiName(name),
+				PypiVersion:        version,
+				CondaName:          pkg.Name,
+				CondaVersion:       pkg.Version,
+				CondaBuild:         pkg.Build,
+				Package:            pkg.Filename,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,46 @@
+package indexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVisitPythonDistributionMetadata(t *testing.T) {
+	const name = "lib/python3.11/site-packages/PyYAML-6.0.dist-info/METADATA"
+	for _, tc := range []struct {
+		desc     string
+		metadata string
+		want     []pypiDistribution
+	}{
+		{
+			"headers up to the body",
+			"Metadata-Version: 2.1\nName: PyYAML\nVersion: 6.0\n\nName: not-a-header\n",
+			[]pypiDistribution{{"PyYAML", "6.0"}},
+		},
+		{
+			"header line longer than the default scanner buffer",
+			"Metadata-Version: 2.1\nName: PyYAML\nVersion: 6.0\nSummary: " + strings.Repeat("x", 200<<10) + "\n",
+			[]pypiDistribution{{"PyYAML", "6.0"}},
+		},
+		{
+			"header line longer than the limit",
+			"Metadata-Version: 2.1\nSummary: " + strings.Repeat("x", 2<<20) + "\nName: PyYAML\n",
+			[]pypiDistribution{},
+		},
+		{
+			"no name",
+			"Metadata-Version: 2.1\nVersion: 6.0\n",
+			[]pypiDistribution{},
+		},
+	} {
+		d := newDeepScanner(1<<20, extractionSettings{PypiNames: true})
+		if err := d.visitPythonDistributionMetadata(name, strings.NewReader(tc.metadata)); err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		got := d.pythonDistributions()
+		if len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package indexer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pythonIdentifier matches the names that can be imported.
+var pythonIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pythonModules derives the importable top-level Python modules and packages of a package from its files:
+// modules, extension modules and packages right under site-packages and, for namespace packages (PEP 420),
+// which have no __init__.py, the namespace package along with the modules and packages inside it.
+// The result is in order, and never nil.
+func pythonModules(files []string) []string {
+	// The files under site-packages, relative to it, and the directories among them that are regular packages
+	var rels []string
+	regularPackages := make(map[string]bool)
+	for _, f := range files {
+		i := strings.LastIndex("/"+f, "/site-packages/")
+		if i < 0 {
+			continue
+		}
+		rel := f[i+len("site-packages/"):]
+		rels = append(rels, rel)
+		if dir, base := splitPythonPath(rel); dir != "" && pythonModuleName(base) == "__init__" {
+			regularPackages[dir] = true
+		}
+	}
+
+	modules := make(map[string]bool)
+	for _, rel := range rels {
+		// Down the chain of namespace packages, up to the first module or regular package. Directories that
+		// hold neither, such as data directories, do not count.
+		elems := strings.Split(rel, "/")
+		var chain []string
+		for depth := 1; depth <= len(elems); depth++ {
+			elem := elems[depth-1]
+			if depth == len(elems) {
+				if name := pythonModuleName(elem); name != "" {
+					chain = append(chain, strings.Join(append(elems[:depth-1:depth-1], name), "."))
+					addAll(modules, chain)
+				}
+				break
+			}
+			if !pythonIdentifier.MatchString(elem) || elem == "__pycache__" {
+				break
+			}
+			chain = append(chain, strings.Join(elems[:depth], "."))
+			if regularPackages[strings.Join(elems[:depth], "/")] {
+				addAll(modules, chain)
+				break
+			}
+		}
+	}
+
+	return sortedKeys(modules)
+}
+
+// addAll adds all of elems to set.
+func addAll(set map[string]bool, elems []string) {
+	for _, elem := range elems {
+		set[elem] = true
+	}
+}
+
+// splitPythonPath splits a slash-separated path into its directory and base name.
+func splitPythonPath(rel string) (string, string) {
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i], rel[i+1:]
+	}
+	return "", rel
+}
+
+// pythonModuleName returns the name a file is imported by, or "" if it is not a module: source files are
+// imported by the name before their extension, and extension modules by the name before the first dot,
+// e.g. _yaml.cpython-311-x86_64-linux-gnu.so.
+func pythonModuleName(base string) string {
+	var name string
+	switch {
+	case strings.HasSuffix(base, ".py"):
+		name = strings.TrimSuffix(base, ".py")
+	case strings.HasSuffix(base, ".so") || strings.HasSuffix(base, ".pyd"):
+		name = strings.SplitN(base, ".", 2)[0]
+	default:
+		return ""
+	}
+	if !pythonIdentifier.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// documentFiles returns the "files" of a metadata document, whether generated or read back.
+func documentFiles(doc map[string]interface{}) []string {
+	switch files := doc["files"].(type) {
+	case []string:
+		return files
+	case []interface{}:
+		return arrayOfObjectsToArrayOfStrings(files, "")
+	default:
+		return nil
+	}
+}
+
+// matchPythonImport returns the most specific of modules that importing name (e.g. "google.protobuf.message")
+// goes through, or "" if there is none.
+func matchPythonImport(modules []string, name string) string {
+	for candidate := name; ; {
+		for _, m := range modules {
+			if m == candidate {
+				return candidate
+			}
+		}
+		i := strings.LastIndex(candidate, ".")
+		if i < 0 {
+			return ""
+		}
+		candidate = candidate[:i]
+	}
+}
+
+// PythonModuleMatch is a package whose Python modules an import goes through Module of.
+type PythonModuleMatch struct {
+	Package string `json:"package"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	Module  string `json:"module"`
+}
+
+// FindSubdirPythonImport returns the packages of the subdir whose working directory is workDir that importing
+// name (e.g. "yaml" or "google.protobuf.message") would load a module of, in order.
+func FindSubdirPythonImport(workDir string, name string) ([]PythonModuleMatch, error) {
+	var res []PythonModuleMatch
+	err := WalkPackageDocuments(workDir, func(pkg PackageDocument) error {
+		modules, ok := pkg.Doc["python_modules"].([]interface{})
+		if !ok {
+			return nil
+		}
+		if module := matchPythonImport(arrayOfObjectsToArrayOfStrings(modules, ""), name); module != "" {
+			res = append(res, PythonModuleMatch{
+				Package: pkg.Filename,
+				Name:    pkg.Name,
+				Version: pkg.Version,
+				Build:   pkg.Build,
+				Module:  module,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,50 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPythonModules(t *testing.T) {
+	const sp = "lib/python3.11/site-packages/"
+	for _, tc := range []struct {
+		desc  string
+		files []string
+		want  []string
+	}{
+		{
+			"regular package",
+			[]string{sp + "yaml/__init__.py", sp + "yaml/loader.py", sp + "yaml/__pycache__/loader.cpython-311.pyc"},
+			[]string{"yaml"},
+		},
+		{
+			"single-file and extension modules",
+			[]string{sp + "six.py", sp + "_yaml.cpython-311-x86_64-linux-gnu.so", "Lib/site-packages/_win.pyd"},
+			[]string{"_win", "_yaml", "six"},
+		},
+		{
+			"namespace package",
+			[]string{sp + "google/protobuf/__init__.py", sp + "google/protobuf/message.py", sp + "google/_upb/_message.abi3.so"},
+			[]string{"google", "google._upb", "google._upb._message", "google.protobuf"},
+		},
+		{
+			"regular package inside a regular package",
+			[]string{sp + "foo/__init__.py", sp + "foo/bar/__init__.py"},
+			[]string{"foo"},
+		},
+		{
+			".pth files, metadata and data directories",
+			[]string{sp + "distutils-precedence.pth", sp + "foo-1.0.dist-info/METADATA", sp + "foo/data/table.csv", sp + "foo-bar/baz.py"},
+			[]string{},
+		},
+		{
+			"outside site-packages",
+			[]string{"bin/foo.py", "lib/python3.11/os.py", "share/site-packages-like/foo.py"},
+			[]string{},
+		},
+	} {
+		if got := pythonModules(tc.files); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
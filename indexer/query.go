@@ -0,0 +1,85 @@
+package indexer
+
+import (
+	"conda-rlookup/helpers"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Ways of matching the files of packages
+const (
+	FileMatchPath     = "path"
+	FileMatchBasename = "basename"
+	FileMatchGlob     = "glob"
+)
+
+// matchesFile tells if the file at name of a package matches pattern, the way by tells (one of the FileMatch* ones).
+func matchesFile(by string, pattern string, name string) bool {
+	switch by {
+	case FileMatchBasename:
+		return path.Base(name) == pattern
+	case FileMatchGlob:
+		return helpers.MatchPathGlob(pattern, name)
+	default:
+		return name == pattern
+	}
+}
+
+// FileMatch is a file of a package that matched a query.
+type FileMatch struct {
+	Query   string `json:"query"`
+	Id      string `json:"id"`
+	Package string `json:"package"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	Path    string `json:"path"`
+}
+
+// FindSubdirFiles returns the files of the packages of the subdir whose working directory is workDir that match
+// any of patterns, the way by tells (one of the FileMatch* ones), in order of pattern and then of package. Every
+// metadata document is read once, whatever the number of patterns. Paths are relative to the prefix the packages
+// are installed into, so a leading "/" of a pattern is ignored.
+func FindSubdirFiles(workDir string, by string, patterns []string) ([]FileMatch, error) {
+	if by != FileMatchPath && by != FileMatchBasename && by != FileMatchGlob {
+		return nil, fmt.Errorf("unknown way of matching %s: must be one of {%s, %s, %s}", by, FileMatchPath, FileMatchBasename, FileMatchGlob)
+	}
+	trimmedPatterns := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		trimmedPatterns[i] = pattern
+		if by != FileMatchBasename {
+			trimmedPatterns[i] = strings.TrimPrefix(pattern, "/")
+		}
+	}
+
+	byPattern := make([][]FileMatch, len(patterns))
+	err := WalkPackageDocuments(workDir, func(pkg PackageDocument) error {
+		for _, f := range documentFiles(pkg.Doc) {
+			for i, pattern := range trimmedPatterns {
+				if !matchesFile(by, pattern, f) {
+					continue
+				}
+				byPattern[i] = append(byPattern[i], FileMatch{
+					Query:   patterns[i],
+					Id:      pkg.Id,
+					Package: pkg.Filename,
+					Name:    pkg.Name,
+					Version: pkg.Version,
+					Build:   pkg.Build,
+					Path:    f,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []FileMatch
+	for _, matches := range byPattern {
+		res = append(res, matches...)
+	}
+	return res, nil
+}
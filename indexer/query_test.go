@@ -0,0 +1,73 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindSubdirFiles(t *testing.T) {
+	workDir := t.TempDir()
+	for name, doc := range map[string]string{
+		"zlib-1.3-0.tar.bz2": `{"id": "svr/ch/linux-64/zlib-1.3-0.tar.bz2", "name": "zlib", "version": "1.3", "build": "0",
+			"files": ["include/zlib.h", "lib/libz.so", "lib/libz.so.1", "lib/pkgconfig/zlib.pc"]}`,
+		"libzip-1.10-0.conda": `{"id": "svr/ch/linux-64/libzip-1.10-0.conda", "name": "libzip", "version": "1.10",
+			"files": ["bin/zipcmp", "include/zip.h", "lib/libzip.so", "share/man/lib/libz.so"]}`,
+	} {
+		if err := os.Mkdir(filepath.Join(workDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(workDir, name, "metadata.json"), []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		by       string
+		patterns []string
+		want     []string // query, package, build and path of every match
+	}{
+		{FileMatchPath, []string{"lib/libz.so"}, []string{"lib/libz.so zlib-1.3-0.tar.bz2 0 lib/libz.so"}},
+		{FileMatchPath, []string{"/include/zip.h", "include/zlib.h"}, []string{
+			"/include/zip.h libzip-1.10-0.conda  include/zip.h",
+			"include/zlib.h zlib-1.3-0.tar.bz2 0 include/zlib.h",
+		}},
+		{FileMatchPath, []string{"libz.so"}, nil},
+		{FileMatchBasename, []string{"libz.so", "zipcmp"}, []string{
+			"libz.so libzip-1.10-0.conda  share/man/lib/libz.so",
+			"libz.so zlib-1.3-0.tar.bz2 0 lib/libz.so",
+			"zipcmp libzip-1.10-0.conda  bin/zipcmp",
+		}},
+		{FileMatchBasename, []string{"/lib/libz.so"}, nil},
+		{FileMatchGlob, []string{"lib/libz*.so*"}, []string{
+			"lib/libz*.so* libzip-1.10-0.conda  lib/libzip.so",
+			"lib/libz*.so* zlib-1.3-0.tar.bz2 0 lib/libz.so",
+			"lib/libz*.so* zlib-1.3-0.tar.bz2 0 lib/libz.so.1",
+		}},
+		{FileMatchGlob, []string{"**/libz.so", "/include/*.h"}, []string{
+			"**/libz.so libzip-1.10-0.conda  share/man/lib/libz.so",
+			"**/libz.so zlib-1.3-0.tar.bz2 0 lib/libz.so",
+			"/include/*.h libzip-1.10-0.conda  include/zip.h",
+			"/include/*.h zlib-1.3-0.tar.bz2 0 include/zlib.h",
+		}},
+	} {
+		found, err := FindSubdirFiles(workDir, tc.by, tc.patterns)
+		if err != nil {
+			t.Errorf("%s %v: %s", tc.by, tc.patterns, err)
+			continue
+		}
+		var got []string
+		for _, m := range found {
+			got = append(got, strings.Join([]string{m.Query, m.Package, m.Build, m.Path}, " "))
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s %v: got\n  %s\nwant\n  %s", tc.by, tc.patterns, strings.Join(got, "\n  "), strings.Join(tc.want, "\n  "))
+		}
+	}
+
+	if _, err := FindSubdirFiles(workDir, "regexp", []string{"lib/.*"}); err == nil {
+		t.Errorf("got no error for an unknown way of matching")
+	}
+}
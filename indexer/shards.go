@@ -0,0 +1,276 @@
+package indexer
+
+import (
+	"bytes"
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// shardedRepodataIndex is the content of repodata_shards.msgpack.zst (CEP-16): the sha256 of
+// the shard of every package name in the subdir.
+type shardedRepodataIndex struct {
+	Info struct {
+		BaseUrl       string `msgpack:"base_url"`
+		ShardsBaseUrl string `msgpack:"shards_base_url"`
+		Subdir        string `msgpack:"subdir"`
+	} `msgpack:"info"`
+	Shards map[string][]byte `msgpack:"shards"`
+}
+
+// repodataShard is the repodata of all the packages of a single name.
+type repodataShard struct {
+	Packages      map[string]map[string]interface{} `msgpack:"packages"`
+	PackagesConda map[string]map[string]interface{} `msgpack:"packages.conda"`
+	Removed       []string                          `msgpack:"removed"`
+}
+
+// readInRepodataFromShards reads the current repodata of subdir s from its sharded repodata in src, and
+// returns it along with the location of the shard index. Shards are named after their sha256, and are kept
+// in the "shards" directory of workDir so that only the ones that are new since the last run are fetched.
+// Shards that are no longer part of the index are deleted. nil is returned without an error if s is not sharded.
+func readInRepodataFromShards(s domain.Subdir, src domain.CondaChannelFileSource, workDir string) (*domain.CondaRepodata, string, error) {
+	logger := helpers.GetAppLogger()
+
+	indexLocation := filepath.Join(s.RelativeLocation, "repodata_shards.msgpack.zst")
+	exists, err := src.FileExists(indexLocation)
+	if err != nil {
+		return nil, "", logger.ErrorPrintf("could not check for %s: %s", indexLocation, err.Error())
+	}
+	if !exists {
+		logger.Printf("[INFO] No sharded repodata found for subdirectory %s", s.RelativeLocation)
+		return nil, "", nil
+	}
+
+	index, err := readInShardedRepodataIndex(src, indexLocation)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The monolithic repodata is read instead of shards that are not in src, or of packages that are not in the subdir
+	shardsLocation, ok := resolveShardIndexUrl(src, indexLocation, index.Info.ShardsBaseUrl)
+	if !ok {
+		logger.Printf("[INFO] Not reading sharded repodata of subdirectory %s: shards base url %s is not in the file source",
+			s.RelativeLocation, index.Info.ShardsBaseUrl)
+		return nil, "", nil
+	}
+	if packagesLocation, ok := resolveShardIndexUrl(src, indexLocation, index.Info.BaseUrl); !ok || packagesLocation != path.Dir(filepath.ToSlash(indexLocation)) {
+		logger.Printf("[INFO] Not reading sharded repodata of subdirectory %s: base url %s is not the subdirectory",
+			s.RelativeLocation, index.Info.BaseUrl)
+		return nil, "", nil
+	}
+
+	shardsDir := filepath.Join(workDir, "shards")
+	if err = os.MkdirAll(shardsDir, 0755); err != nil {
+		return nil, "", logger.ErrorPrintf("could not create shards directory %s: %s", shardsDir, err.Error())
+	}
+
+	names := make([]string, 0, len(index.Shards))
+	for name := range index.Shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := domain.NewCondaRepodata()
+	keep := make(map[string]bool)
+	var nFetched int
+	for _, name := range names {
+		shardFilename := hex.EncodeToString(index.Shards[name]) + ".msgpack.zst"
+		shardFilepath := filepath.Join(shardsDir, shardFilename)
+		keep[shardFilename] = true
+
+		if _, err = os.Stat(shardFilepath); os.IsNotExist(err) {
+			if err = fetchShardIntoFile(src, path.Join(shardsLocation, shardFilename), shardFilepath, index.Shards[name]); err != nil {
+				return nil, "", logger.ErrorPrintf("could not fetch shard of package %s: %s", name, err.Error())
+			}
+			nFetched += 1
+		}
+
+		shard, err := readInShardFile(shardFilepath)
+		if err != nil {
+			return nil, "", logger.ErrorPrintf("could not read shard of package %s: %s", name, err.Error())
+		}
+		for pkgFilename, pkg := range shard.Packages {
+			res.Packages[pkgFilename] = normalizeShardValue(pkg).(map[string]interface{})
+		}
+		for pkgFilename, pkg := range shard.PackagesConda {
+			res.PackagesConda[pkgFilename] = normalizeShardValue(pkg).(map[string]interface{})
+		}
+		res.Removed = append(res.Removed, shard.Removed...)
+	}
+	sort.Strings(res.Removed)
+
+	entries, err := ioutil.ReadDir(shardsDir)
+	if err != nil {
+		return nil, "", logger.ErrorPrintf("could not list shards directory %s: %s", shardsDir, err.Error())
+	}
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			if err = os.Remove(filepath.Join(shardsDir, entry.Name())); err != nil {
+				logger.Printf("[ERROR] Could not delete stale shard %s: %s", entry.Name(), err.Error())
+			}
+		}
+	}
+
+	logger.Printf("[INFO] Read %d shards of subdirectory %s, %d of which were fetched", len(names), s.RelativeLocation, nFetched)
+	return res, indexLocation, nil
+}
+
+// resolveShardIndexUrl resolves ref, a url in the info of the shard index at indexLocation in src, to a location
+// in src. Relative urls are resolved against the index, and absolute ones only against the base url of src, if it
+// has one i.e. is an HTTP source. ok is false if ref is not in src.
+func resolveShardIndexUrl(src domain.CondaChannelFileSource, indexLocation string, ref string) (string, bool) {
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+
+	if !refUrl.IsAbs() && refUrl.Host == "" {
+		location := path.Join(path.Dir(filepath.ToSlash(indexLocation)), refUrl.Path)
+		return location, location != ".." && !strings.HasPrefix(location, "../")
+	}
+
+	urlSrc, ok := src.(interface{ GetFileUrl(string) string })
+	if !ok {
+		return "", false
+	}
+	baseUrl, err := url.Parse(urlSrc.GetFileUrl(""))
+	if err != nil || refUrl.Scheme != baseUrl.Scheme || refUrl.Host != baseUrl.Host {
+		return "", false
+	}
+	refPath, basePath := path.Clean(refUrl.Path), strings.TrimSuffix(baseUrl.Path, "/")
+	if !strings.HasPrefix(refPath+"/", basePath+"/") {
+		return "", false
+	}
+	return path.Clean(strings.TrimPrefix(refPath[len(basePath):], "/")), true
+}
+
+func readInShardedRepodataIndex(src domain.CondaChannelFileSource, indexLocation string) (*shardedRepodataIndex, error) {
+	logger := helpers.GetAppLogger()
+
+	r, err := src.GetFileReadCloser(indexLocation)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not read %s: %s", indexLocation, err.Error())
+	}
+	defer r.Close()
+
+	decompReader, err := helpers.NewDecompressingReadCloser(indexLocation, r)
+	if err != nil {
+		return nil, logger.ErrorPrintf("could not decompress %s: %s", indexLocation, err.Error())
+	}
+	defer decompReader.Close()
+
+	var index shardedRepodataIndex
+	if err = msgpack.NewDecoder(decompReader).Decode(&index); err != nil {
+		return nil, logger.ErrorPrintf("could not read and parse %s: %s", indexLocation, err.Error())
+	}
+
+	return &index, nil
+}
+
+// fetchShardIntoFile fetches the shard at shardLocation in src into filename, provided its sha256 is checksum.
+func fetchShardIntoFile(src domain.CondaChannelFileSource, shardLocation string, filename string, checksum []byte) error {
+	r, err := src.GetFileReadCloser(shardLocation)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := renameio.TempFile("", filename)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer f.Cleanup()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+
+	if actual := h.Sum(nil); !bytes.Equal(actual, checksum) {
+		return fmt.Errorf("checksum mismatch for %s: expected %x, got %x", shardLocation, checksum, actual)
+	}
+
+	return f.CloseAtomicallyReplace()
+}
+
+func readInShardFile(filename string) (*repodataShard, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decompReader, err := helpers.NewDecompressingReadCloser(filename, f)
+	if err != nil {
+		return nil, err
+	}
+	defer decompReader.Close()
+
+	var shard repodataShard
+	if err = msgpack.NewDecoder(decompReader).Decode(&shard); err != nil {
+		return nil, err
+	}
+
+	return &shard, nil
+}
+
+// normalizeShardValue turns a value decoded from msgpack into what encoding/json would decode the same
+// value in repodata.json as, so that sharded and monolithic repodata can be used interchangeably: numbers
+// become float64 and binary strings, such as checksums, become hex strings.
+func normalizeShardValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = normalizeShardValue(elem)
+		}
+		return v
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			res[fmt.Sprint(k)] = normalizeShardValue(elem)
+		}
+		return res
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeShardValue(elem)
+		}
+		return v
+	case []byte:
+		return hex.EncodeToString(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,213 @@
+package indexer
+
+import (
+	"conda-rlookup/domain"
+	"conda-rlookup/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fakeShardedChannel writes the sharded repodata of the subdir "ch/linux-64" into a directory.
+type fakeShardedChannel struct {
+	t      *testing.T
+	dir    string
+	index  shardedRepodataIndex
+	shards map[string][]byte // the checksums of the shards written, by package name
+}
+
+func newFakeShardedChannel(t *testing.T) *fakeShardedChannel {
+	c := &fakeShardedChannel{t: t, dir: t.TempDir(), shards: make(map[string][]byte)}
+	c.index.Info.ShardsBaseUrl = "./shards/"
+	return c
+}
+
+func (c *fakeShardedChannel) writeZstdMsgpack(relativeFilepath string, v interface{}) []byte {
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = enc.EncodeAll(data, nil)
+
+	filename := filepath.Join(c.dir, filepath.FromSlash(relativeFilepath))
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		c.t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// putShard writes the shard of name, holding a .tar.bz2 package of each of versions.
+func (c *fakeShardedChannel) putShard(name string, versions ...string) {
+	shard := repodataShard{Packages: make(map[string]map[string]interface{})}
+	for _, version := range versions {
+		shard.Packages[name+"-"+version+"-0.tar.bz2"] = map[string]interface{}{
+			"name":    name,
+			"version": version,
+			"build":   "0",
+			"size":    uint32(42),
+			"sha256":  []byte{0xde, 0xad, 0xbe, 0xef},
+		}
+	}
+
+	// Shards are named after their checksum, which is only known once they are written
+	tmp := "ch/linux-64/shards/tmp.msgpack.zst"
+	sum := c.writeZstdMsgpack(tmp, shard)
+	shardsDir := filepath.Join(c.dir, "ch", "linux-64", "shards")
+	if err := os.Rename(filepath.Join(c.dir, filepath.FromSlash(tmp)), filepath.Join(shardsDir, hex.EncodeToString(sum)+".msgpack.zst")); err != nil {
+		c.t.Fatal(err)
+	}
+	c.shards[name] = sum
+}
+
+// writeIndex writes the shard index of the shards put so far.
+func (c *fakeShardedChannel) writeIndex() {
+	c.index.Shards = c.shards
+	c.writeZstdMsgpack("ch/linux-64/repodata_shards.msgpack.zst", c.index)
+}
+
+func (c *fakeShardedChannel) localSource() domain.CondaChannelFileSource {
+	src := &helpers.LocalFileSource{SourceDir: c.dir, TempDir: c.t.TempDir()}
+	if err := src.Init(); err != nil {
+		c.t.Fatal(err)
+	}
+	return src
+}
+
+func packageFilenames(r *domain.CondaRepodata) string {
+	var res []string
+	for name := range r.AllPackages() {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return strings.Join(res, " ")
+}
+
+func TestReadInRepodataFromShardsDecodesIndex(t *testing.T) {
+	c := newFakeShardedChannel(t)
+	c.putShard("foo", "1.0", "2.0")
+	c.putShard("bar", "0.1")
+	c.writeIndex()
+
+	r, location, err := readInRepodataFromShards(domain.Subdir{RelativeLocation: "ch/linux-64"}, c.localSource(), t.TempDir())
+	if err != nil {
+		t.Fatalf("readInRepodataFromShards: %s", err)
+	}
+	if r == nil {
+		t.Fatal("got no repodata")
+	}
+
+	if location != filepath.Join("ch", "linux-64", "repodata_shards.msgpack.zst") {
+		t.Errorf("got location %s", location)
+	}
+	if got, want := packageFilenames(r), "bar-0.1-0.tar.bz2 foo-1.0-0.tar.bz2 foo-2.0-0.tar.bz2"; got != want {
+		t.Errorf("got packages %s, want %s", got, want)
+	}
+	// Values are as they would be decoded from repodata.json
+	pkg := r.Packages["foo-2.0-0.tar.bz2"]
+	if pkg["size"] != float64(42) || pkg["sha256"] != "deadbeef" || pkg["version"] != "2.0" {
+		t.Errorf("got package %v", pkg)
+	}
+}
+
+func TestReadInRepodataFromShardsFetchesChangedShardsOnly(t *testing.T) {
+	c := newFakeShardedChannel(t)
+	c.putShard("foo", "1.0")
+	c.putShard("bar", "0.1")
+	c.writeIndex()
+	s := domain.Subdir{RelativeLocation: "ch/linux-64"}
+	src := c.localSource()
+	workDir := t.TempDir()
+
+	if _, _, err := readInRepodataFromShards(s, src, workDir); err != nil {
+		t.Fatalf("readInRepodataFromShards: %s", err)
+	}
+
+	// Only the shard of foo changes; the unchanged shard of bar cannot be fetched again
+	oldFoo, bar := hex.EncodeToString(c.shards["foo"]), hex.EncodeToString(c.shards["bar"])
+	if err := os.Remove(filepath.Join(c.dir, "ch", "linux-64", "shards", bar+".msgpack.zst")); err != nil {
+		t.Fatal(err)
+	}
+	c.putShard("foo", "1.0", "1.1")
+	c.writeIndex()
+
+	r, _, err := readInRepodataFromShards(s, src, workDir)
+	if err != nil {
+		t.Fatalf("readInRepodataFromShards after foo changed: %s", err)
+	}
+	if got, want := packageFilenames(r), "bar-0.1-0.tar.bz2 foo-1.0-0.tar.bz2 foo-1.1-0.tar.bz2"; got != want {
+		t.Errorf("got packages %s, want %s", got, want)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(workDir, "shards"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, strings.TrimSuffix(entry.Name(), ".msgpack.zst"))
+	}
+	sort.Strings(kept)
+	want := []string{bar, hex.EncodeToString(c.shards["foo"])}
+	sort.Strings(want)
+	if strings.Join(kept, " ") != strings.Join(want, " ") {
+		t.Errorf("got shards %v kept, want %v (and not the old shard of foo %s)", kept, want, oldFoo)
+	}
+}
+
+func TestReadInRepodataFromShardsResolvesUrls(t *testing.T) {
+	c := newFakeShardedChannel(t)
+	c.putShard("foo", "1.0")
+	svr := httptest.NewServer(http.FileServer(http.Dir(c.dir)))
+	defer svr.Close()
+	httpSrc := &helpers.HttpFileSource{BaseUrl: svr.URL + "/"}
+	if err := httpSrc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc          string
+		src           domain.CondaChannelFileSource
+		baseUrl       string
+		shardsBaseUrl string
+		sharded       bool
+	}{
+		{"relative", c.localSource(), "", "./shards/", true},
+		{"relative to the parent", c.localSource(), "../linux-64/", "../linux-64/shards", true},
+		{"absolute under an HTTP source", httpSrc, svr.URL + "/ch/linux-64/", svr.URL + "/ch/linux-64/shards/", true},
+		{"absolute elsewhere", httpSrc, "", "https://shards.example.com/ch/linux-64/shards/", false},
+		{"absolute with a local source", c.localSource(), "", svr.URL + "/ch/linux-64/shards/", false},
+		{"packages elsewhere", c.localSource(), "https://conda.example.com/ch/linux-64/", "./shards/", false},
+		{"packages in another subdir", c.localSource(), "../noarch/", "./shards/", false},
+		{"outside the source", c.localSource(), "", "../../../shards/", false},
+	} {
+		c.index.Info.BaseUrl, c.index.Info.ShardsBaseUrl = tc.baseUrl, tc.shardsBaseUrl
+		c.writeIndex()
+
+		r, _, err := readInRepodataFromShards(domain.Subdir{RelativeLocation: "ch/linux-64"}, tc.src, t.TempDir())
+		if err != nil {
+			t.Errorf("%s: %s", tc.desc, err)
+			continue
+		}
+		if sharded := r != nil; sharded != tc.sharded {
+			t.Errorf("%s: got sharded %t, want %t", tc.desc, sharded, tc.sharded)
+		}
+	}
+}
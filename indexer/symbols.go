@@ -0,0 +1,127 @@
+package indexer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"conda-rlookup/helpers"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// The dynamic symbols exported by the shared libraries of a package are kept in its directory, rather than in
+// its metadata document, as gzipped "<symbol>\t<version>\t<library path>" lines in order.
+const symbolsFilename = "symbols.tsv.gz"
+
+// writeSymbolsFile writes the exported symbols found by d into prefixDir, or removes the symbols file there if
+// d is nil or does not look for symbols.
+func writeSymbolsFile(prefixDir string, d *deepScanner) error {
+	logger := helpers.GetAppLogger()
+
+	filename := filepath.Join(prefixDir, symbolsFilename)
+	if d == nil || !d.symbols {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return logger.ErrorPrintf("could not remove %s: %s", filename, err.Error())
+		}
+		return nil
+	}
+
+	f, err := renameio.TempFile("", filename)
+	if err != nil {
+		return logger.ErrorPrintf("could not open temp file for %s: %s", filename, err.Error())
+	}
+	//nolint:errcheck
+	defer f.Cleanup()
+
+	gzw := gzip.NewWriter(f)
+	w := bufio.NewWriter(gzw)
+	for _, line := range sortedKeys(d.exportedSymbols) {
+		fmt.Fprintln(w, line)
+	}
+	if err = w.Flush(); err != nil {
+		return logger.ErrorPrintf("could not write %s: %s", filename, err.Error())
+	}
+	if err = gzw.Close(); err != nil {
+		return logger.ErrorPrintf("could not write %s: %s", filename, err.Error())
+	}
+	if err = f.CloseAtomicallyReplace(); err != nil {
+		return logger.ErrorPrintf("could not replace %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// SymbolMatch is an exported symbol of a shared library in a package.
+type SymbolMatch struct {
+	Package string `json:"package"`
+	Symbol  string `json:"symbol"`
+	Version string `json:"version"`
+	Library string `json:"library"`
+}
+
+// FindSubdirSymbols returns the exported symbols called name of the packages of the subdir whose working
+// directory is workDir, in order. Unless version is "", only symbols of that version are returned.
+func FindSubdirSymbols(workDir string, name string, version string) ([]SymbolMatch, error) {
+	var res []SymbolMatch
+	err := WalkPackageDirs(workDir, func(pkgFilename string, pkgDir string) error {
+		filename := filepath.Join(pkgDir, symbolsFilename)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return nil
+		}
+
+		matches, err := findSymbolsInFile(filename, name, version)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", filename, err.Error())
+		}
+		for _, m := range matches {
+			m.Package = pkgFilename
+			res = append(res, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func findSymbolsInFile(filename string, name string, version string) ([]SymbolMatch, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	var res []SymbolMatch
+	prefix := name + "\t"
+	scanner := bufio.NewScanner(gzr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			// Lines are in order, so there are no more matches past them
+			if len(res) > 0 {
+				break
+			}
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 || (version != "" && fields[1] != version) {
+			continue
+		}
+		res = append(res, SymbolMatch{Symbol: fields[0], Version: fields[1], Library: fields[2]})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WalkSubdirWorkdirs calls fn, in lexical order, for the working directory of every subdir indexed under
+// prefixDir along with the relative location of the subdir. Subdir working directories are told apart by
+// their repodata history, and are not descended into.
+func WalkSubdirWorkdirs(prefixDir string, fn func(relativeLocation string, workDir string) error) error {
+	return filepath.Walk(prefixDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, err = os.Stat(filepath.Join(path, "repodata.json.history")); err != nil {
+			return nil
+		}
+
+		relativeLocation, err := filepath.Rel(prefixDir, path)
+		if err != nil {
+			return err
+		}
+		if err = fn(relativeLocation, path); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// WalkPackageDirs calls fn, in lexical order, for the directory of every package in the working directory of
+// a subdir along with the package filename. Packages whose metadata document has not been generated are left out.
+func WalkPackageDirs(workDir string, fn func(pkgFilename string, pkgDir string) error) error {
+	entries, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		pkgDir := filepath.Join(workDir, entry.Name())
+		if _, err = os.Stat(filepath.Join(pkgDir, "metadata.json")); err != nil {
+			continue
+		}
+		if err = fn(entry.Name(), pkgDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PackageDocument is the metadata document of a package in the working directory of a subdir, along with the
+// fields of it that tell the package apart. These are "" if the document lacks them.
+type PackageDocument struct {
+	Filename string
+	Id       string
+	Name     string
+	Version  string
+	Build    string
+	Doc      map[string]interface{}
+}
+
+// WalkPackageDocuments calls fn, in lexical order, for the metadata document of every package in the working
+// directory of a subdir. Packages whose metadata document has not been generated are left out.
+func WalkPackageDocuments(workDir string, fn func(pkg PackageDocument) error) error {
+	return WalkPackageDirs(workDir, func(pkgFilename string, pkgDir string) error {
+		doc, err := ReadMetadataDocument(pkgDir)
+		if err != nil {
+			return fmt.Errorf("could not read metadata document of %s: %s", pkgFilename, err.Error())
+		}
+		return fn(PackageDocument{
+			Filename: pkgFilename,
+			Id:       documentString(doc, "id"),
+			Name:     documentString(doc, "name"),
+			Version:  documentString(doc, "version"),
+			Build:    documentString(doc, "build"),
+			Doc:      doc,
+		})
+	})
+}
+
+// documentString returns the field key of a metadata document if it is a string, and "" otherwise.
+func documentString(doc map[string]interface{}, key string) string {
+	s, _ := doc[key].(string)
+	return s
+}
+
+// ReadMetadataDocument reads the metadata document of the package whose directory is pkgDir.
+func ReadMetadataDocument(pkgDir string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filepath.Join(pkgDir, "metadata.json"))
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,48 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkPackageDocuments(t *testing.T) {
+	workDir := t.TempDir()
+	for name, doc := range map[string]string{
+		"foo-1.0-0.tar.bz2": `{"id": "svr/ch/linux-64/foo-1.0-0.tar.bz2", "name": "foo", "version": "1.0", "build": "0"}`,
+		"bar-2.0-1.conda":   `{"name": "bar", "version": 2, "build": null}`,
+		"baz-1.0-0.conda":   "",
+	} {
+		pkgDir := filepath.Join(workDir, name)
+		if err := os.Mkdir(pkgDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if doc == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(pkgDir, "metadata.json"), []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []PackageDocument
+	err := WalkPackageDocuments(workDir, func(pkg PackageDocument) error {
+		pkg.Doc = nil
+		got = append(got, pkg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkPackageDocuments: %s", err)
+	}
+
+	// Packages without a metadata document are left out, and fields that are not strings are empty
+	want := []PackageDocument{
+		{Filename: "bar-2.0-1.conda", Name: "bar"},
+		{Filename: "foo-1.0-0.tar.bz2", Id: "svr/ch/linux-64/foo-1.0-0.tar.bz2", Name: "foo", Version: "1.0", Build: "0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"conda-rlookup/config"
+	"conda-rlookup/domain"
 	"conda-rlookup/helpers"
 	"conda-rlookup/indexer"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
@@ -19,6 +23,9 @@ const (
 	ERR_KAFKA_INIT
 	ERR_SUBDIR_REPODATA_INDEX
 	ERR_KAFKA_DOC_UPDATE
+	ERR_SOURCE_INIT
+	ERR_SUBDIR_DISCOVERY
+	ERR_COMMAND
 )
 
 func main() {
@@ -30,6 +37,7 @@ func main() {
 	dumpConfig := flag.Bool("dump-config", false, "Dump all configuration and exit. '--config' supplied config is combined as well.")
 	skipKafka := flag.Bool("skip-kafka", false, "Only index repodata and skip pushing to kafka")
 	skipRepodata := flag.Bool("skip-repodata", false, "Only try pushing to kafka and skip indexing repodata")
+	force := flag.Bool("force", false, "Index subdirs even if their repodata has not changed since the last run (overrides config file)")
 
 	flag.Parse()
 
@@ -71,6 +79,15 @@ func main() {
 
 	appCfg := config.GetAppConfig()
 
+	if *force {
+		appCfg.Server.Indexer.SkipUnchanged = "false"
+	}
+
+	// Run a subcommand and exit, if one is given
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(&appCfg.Server, flag.Args()))
+	}
+
 	logger.Printf("[INFO] Ensuring working directory: %s\n", appCfg.Server.Workdir)
 	if err = os.MkdirAll(appCfg.Server.Workdir, 0755); err != nil {
 		logger.Printf("[ERROR] Could not create working directory %s: %s", appCfg.Server.Workdir, err.Error())
@@ -88,52 +105,84 @@ func main() {
 		}
 	}
 
-	// TODO: Finish support for HTTP sources
-	localSrc := helpers.LocalFileSource{
-		TempDir:                          "/tmp",
-		RepodataLockFilename:             appCfg.Server.RepodataLockFilename,
-		RepodataLockMaxWaitSeconds:       20,
-		RepodataLockRetryIntervalSeconds: 2,
-		SourceDir:                        appCfg.Server.Path,
+	src, err := helpers.NewChannelFileSource(&appCfg.Server, appCfg.Server.Auth)
+	if err != nil {
+		logger.Printf("[ERROR] Could not initialize file source for conda server %s: %s", appCfg.Server.Name, err.Error())
+		os.Exit(ERR_SOURCE_INIT)
 	}
 
-	if appCfg.Server.RepodataLockMaxWaitSeconds > 0 {
-		localSrc.RepodataLockMaxWaitSeconds = appCfg.Server.RepodataLockMaxWaitSeconds
+	if strings.ToLower(appCfg.Server.Discovery.Enabled) == "true" {
+		logger.Printf("[INFO] Discovering subdirectories of conda server: %s", appCfg.Server.Name)
+		discovered, err := indexer.DiscoverSubdirs(src, appCfg.Server.Discovery, appCfg.Server.Indexer.RepodataCompressions)
+		if err != nil {
+			logger.Printf("[ERROR] Could not discover subdirectories of conda server %s: %s", appCfg.Server.Name, err.Error())
+			os.Exit(ERR_SUBDIR_DISCOVERY)
+		}
+		appCfg.Server.Channels = indexer.MergeDiscoveredSubdirs(appCfg.Server.Channels, discovered)
 	}
 
-	if appCfg.Server.RepodataLockRetryIntervalSeconds > 0 {
-		localSrc.RepodataLockRetryIntervalSeconds = appCfg.Server.RepodataLockRetryIntervalSeconds
+	// Subdirs are processed up to SubdirConcurrency at a time. Each one is indexed and then flushed to kafka
+	// by a single goroutine, so the kafka messages of a subdir go out in the same order as when run serially.
+	nConcurrent := appCfg.Server.SubdirConcurrency
+	if nConcurrent < 1 {
+		nConcurrent = 1
 	}
 
 	var subdirRepodataFailed, subdirKafkaFailed []string
+	var failedMu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, nConcurrent)
 
 	for _, ch := range appCfg.Server.Channels {
 		logger.Printf("[INFO] Started Processing conda-channel: %s", ch.RelativeLocation)
-		for _, subdir := range ch.Subdirs {
-			logger.Printf("[INFO] Started Processing subdirectory: %s", subdir.RelativeLocation)
-			if *skipRepodata {
-				logger.Printf("[INFO] Skipping repodata indexing for subdirectory %s because skip-repodata option is set", subdir.RelativeLocation)
-			} else {
-				logger.Printf("[INFO] Started Indexing for subdirectory: %s", subdir.RelativeLocation)
-				err := indexer.IndexSubdir(subdir, appCfg.Server.Workdir, "conda-master", &localSrc)
-				if err != nil {
-					logger.Printf("[ERROR] In indexing subdirectory %s: %s", subdir.RelativeLocation, err.Error())
+
+		chSrc := src
+		if ch.Auth.Type != "" {
+			if chSrc, err = helpers.NewChannelFileSource(&appCfg.Server, ch.Auth); err != nil {
+				logger.Printf("[ERROR] Could not initialize file source for conda-channel %s: %s", ch.RelativeLocation, err.Error())
+				failedMu.Lock()
+				for _, subdir := range ch.Subdirs {
 					subdirRepodataFailed = append(subdirRepodataFailed, subdir.RelativeLocation)
 				}
+				failedMu.Unlock()
+				continue
 			}
-			if *skipKafka {
-				logger.Printf("[INFO] Skipping pushing to kafka for subdirectory %s because skip-kafka option is set", subdir.RelativeLocation)
-			} else {
-				logger.Printf("[INFO] Started pushing to kafka for subdirectory: %s", subdir.RelativeLocation)
-				if err = indexer.SubdirFlushToKafka(subdir, appCfg.Server.Workdir); err != nil {
-					logger.Printf("[ERROR] In pushing stats to kafka for subdir %s: %s", subdir.RelativeLocation, err.Error())
+		}
+
+		var chWg sync.WaitGroup
+		for _, subdir := range ch.Subdirs {
+			slots <- struct{}{}
+			wg.Add(1)
+			chWg.Add(1)
+			go func(subdir domain.Subdir, src domain.CondaChannelFileSource) {
+				defer wg.Done()
+				defer chWg.Done()
+				defer func() { <-slots }()
+
+				repodataFailed, kafkaFailed := processSubdir(&appCfg.Server, subdir, src, *skipRepodata, *skipKafka)
+
+				failedMu.Lock()
+				if repodataFailed {
+					subdirRepodataFailed = append(subdirRepodataFailed, subdir.RelativeLocation)
+				}
+				if kafkaFailed {
 					subdirKafkaFailed = append(subdirKafkaFailed, subdir.RelativeLocation)
 				}
-				logger.Printf("[INFO] Finished Processing subdirectory: %s", subdir.RelativeLocation)
-			}
+				failedMu.Unlock()
+			}(subdir, chSrc)
 		}
-		logger.Printf("[INFO] Finished Processing conda-channel: %s", ch.RelativeLocation)
+
+		wg.Add(1)
+		go func(chLocation string) {
+			defer wg.Done()
+			chWg.Wait()
+			logger.Printf("[INFO] Finished Processing conda-channel: %s", chLocation)
+		}(ch.RelativeLocation)
 	}
+	wg.Wait()
+
+	sort.Strings(subdirRepodataFailed)
+	sort.Strings(subdirKafkaFailed)
 
 	var retErrCode = ERR_NONE
 	if len(subdirRepodataFailed) != 0 {
@@ -149,6 +198,36 @@ func main() {
 	os.Exit(retErrCode)
 }
 
+// processSubdir indexes a subdir of svr from src and then pushes its kafkadocs to kafka, unless either is
+// to be skipped. It tells which of the two failed.
+func processSubdir(svr *domain.CondaServer, subdir domain.Subdir, src domain.CondaChannelFileSource, skipRepodata bool, skipKafka bool) (repodataFailed bool, kafkaFailed bool) {
+	logger := helpers.GetAppLogger()
+
+	logger.Printf("[INFO] Started Processing subdirectory: %s", subdir.RelativeLocation)
+	if skipRepodata {
+		logger.Printf("[INFO] Skipping repodata indexing for subdirectory %s because skip-repodata option is set", subdir.RelativeLocation)
+	} else {
+		logger.Printf("[INFO] Started Indexing for subdirectory: %s", subdir.RelativeLocation)
+		err := indexer.IndexSubdir(subdir, svr.Workdir, "conda-master", src, svr.Indexer)
+		if err != nil {
+			logger.Printf("[ERROR] In indexing subdirectory %s: %s", subdir.RelativeLocation, err.Error())
+			repodataFailed = true
+		}
+	}
+	if skipKafka {
+		logger.Printf("[INFO] Skipping pushing to kafka for subdirectory %s because skip-kafka option is set", subdir.RelativeLocation)
+	} else {
+		logger.Printf("[INFO] Started pushing to kafka for subdirectory: %s", subdir.RelativeLocation)
+		if err := indexer.SubdirFlushToKafka(subdir, svr.Workdir); err != nil {
+			logger.Printf("[ERROR] In pushing stats to kafka for subdir %s: %s", subdir.RelativeLocation, err.Error())
+			kafkaFailed = true
+		}
+		logger.Printf("[INFO] Finished Processing subdirectory: %s", subdir.RelativeLocation)
+	}
+
+	return repodataFailed, kafkaFailed
+}
+
 func printVersion() {
 	version := config.GetVersion()
 	fmt.Printf("Name: %s, Version: %s, GitCommitSha: %s, BuildTime: %s, BuildHost: %s, BuildUser: %s\n",